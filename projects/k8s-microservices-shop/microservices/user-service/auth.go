@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// contextKey namespaces values stored on request contexts
+type contextKey string
+
+// roleContextKey holds the authenticated caller's role
+const roleContextKey contextKey = "role"
+
+// subjectContextKey holds the authenticated caller's subject (the sub claim)
+const subjectContextKey contextKey = "subject"
+
+// userHolderContextKey holds a *string the auth middleware sets to the
+// caller's subject, so middleware that runs before it, like the access log,
+// can still report who made the request
+const userHolderContextKey contextKey = "user_holder"
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// jwtClaims are the claims the service understands
+type jwtClaims struct {
+	Subject   string `json:"sub,omitempty"`
+	Role      string `json:"role,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenNotYet    = errors.New("token not yet valid")
+)
+
+// defaultRoleHierarchy lets admins through customer-level checks
+const defaultRoleHierarchy = "admin>customer"
+
+// parseRoleHierarchy parses a role ordering like "admin>customer" into a
+// rank per role, higher ranks satisfying checks for lower ones
+func parseRoleHierarchy(value string) (map[string]int, error) {
+	roles := strings.Split(value, ">")
+	ranks := make(map[string]int, len(roles))
+	for i, role := range roles {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			return nil, fmt.Errorf("empty role in %q", value)
+		}
+		if _, seen := ranks[role]; seen {
+			return nil, fmt.Errorf("role %q listed twice", role)
+		}
+		ranks[role] = len(roles) - i
+	}
+	return ranks, nil
+}
+
+// signToken mints an HS256 token for the given claims
+func signToken(claims jwtClaims, secret []byte) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signHS256(signingInput, secret)), nil
+}
+
+// parseToken verifies an HS256 token and returns its claims. Tokens must
+// carry an expiry; exp and nbf are checked against now (Unix seconds).
+func parseToken(token string, secret []byte, now int64) (jwtClaims, error) {
+	var claims jwtClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errTokenMalformed
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Algorithm != "HS256" {
+		return claims, errTokenMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	if !hmac.Equal(signature, signHS256(parts[0]+"."+parts[1], secret)) {
+		return claims, errTokenSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return claims, errTokenMalformed
+	}
+
+	if now >= claims.ExpiresAt {
+		return claims, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return claims, errTokenNotYet
+	}
+
+	return claims, nil
+}
+
+func signHS256(signingInput string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// roleFromContext returns the authenticated caller's role, if any
+func roleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleContextKey).(string)
+	return role
+}
+
+// Middleware requiring a valid bearer token on every route except the
+// public probe and metrics paths
+func (us *UserService) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if us.publicPaths[r.URL.Path] || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeUnauthorized(w, "Missing bearer token")
+			return
+		}
+
+		claims, err := parseToken(token, us.jwtSecret, us.clock.Now().Unix())
+		if err != nil {
+			us.requestLogger(r).WithFields(logrus.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"reason": err.Error(),
+			}).Warn("Rejected bearer token")
+
+			message := "Invalid token"
+			if err == errTokenExpired {
+				message = "Token expired"
+			}
+			writeUnauthorized(w, message)
+			return
+		}
+
+		if holder, ok := r.Context().Value(userHolderContextKey).(*string); ok {
+			*holder = claims.Subject
+		}
+
+		ctx := context.WithValue(r.Context(), roleContextKey, claims.Role)
+		ctx = context.WithValue(ctx, subjectContextKey, claims.Subject)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireMetricsToken guards the metrics endpoint with a static token,
+// accepted as a bearer token or as the password of HTTP basic auth so any
+// Prometheus scrape config can supply it
+func (us *UserService) requireMetricsToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		supplied, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, supplied, ok = r.BasicAuth()
+		}
+		if ok && subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		us.requestLogger(r).WithFields(logrus.Fields{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"ip":     us.clientIP(r),
+		}).Warn("Rejected metrics scrape")
+
+		writeUnauthorized(w, "Invalid metrics token")
+	})
+}
+
+// writeUnauthorized responds 401 with a bearer challenge
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="user-service"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// hasRole reports whether caller is role or ranks above it in the hierarchy.
+// Roles outside the hierarchy only satisfy themselves.
+func (us *UserService) hasRole(caller, role string) bool {
+	if caller == role {
+		return true
+	}
+	callerRank, callerRanked := us.roleRanks[caller]
+	roleRank, roleRanked := us.roleRanks[role]
+	return callerRanked && roleRanked && callerRank > roleRank
+}
+
+// requireRole wraps a handler so only callers whose token carries the given
+// role, or one above it in the hierarchy, reach it; everyone else gets a 403.
+// It is a no-op while authentication is disabled, since no request has a
+// role then.
+func (us *UserService) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(us.jwtSecret) == 0 || us.hasRole(roleFromContext(r.Context()), role) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			us.requestsTotal.WithLabelValues(r.Method, routeEndpoint(r), "403").Inc()
+
+			us.requestLogger(r).WithFields(logrus.Fields{
+				"method":   r.Method,
+				"path":     r.URL.Path,
+				"role":     roleFromContext(r.Context()),
+				"required": role,
+			}).Warn("Forbidden")
+
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Requires " + role + " role"})
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bearerFor mints a token for role signed with secret and returns it as an
+// Authorization header
+func bearerFor(t *testing.T, secret, subject, role string) map[string]string {
+	t.Helper()
+	token, err := signToken(jwtClaims{
+		Subject:   subject,
+		Role:      role,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, []byte(secret))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestWriteAndAdminRoutesRequireAdminRole(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"JWT_SECRET":      "test-secret",
+		"ADMIN_ENDPOINTS": "true",
+		"RATE_LIMIT_RPS":  "0",
+	})
+	handler := us.Handler()
+	customer := bearerFor(t, "test-secret", userIDByName(t, us, "john_doe"), "customer")
+	admin := bearerFor(t, "test-secret", userIDByName(t, us, "admin"), "admin")
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	routes := []struct {
+		method, path, body string
+	}{
+		{"POST", "/users", `{"username":"new","email":"new@example.com","role":"customer"}`},
+		{"POST", "/users/batch", `[]`},
+		{"PUT", john, `{"username":"x","email":"x@example.com","role":"admin"}`},
+		{"PATCH", john, `{"role":"admin"}`},
+		{"DELETE", john, ""},
+		{"GET", "/users/export", ""},
+		{"GET", "/admin/echo", ""},
+		{"POST", "/admin/snapshot", ""},
+		{"POST", "/admin/restore", `{}`},
+		{"GET", "/admin/maintenance", ""},
+		{"PUT", "/admin/maintenance", `{"enabled":true}`},
+	}
+	for _, route := range routes {
+		rec := doRequest(handler, route.method, route.path, route.body, customer)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s as customer = %d, want 403", route.method, route.path, rec.Code)
+		}
+	}
+
+	// The admin gets past the role check; GET is used so nothing changes
+	for _, path := range []string{"/users/export", "/admin/echo", "/admin/maintenance"} {
+		if rec := doRequest(handler, "GET", path, "", admin); rec.Code != http.StatusOK {
+			t.Errorf("GET %s as admin = %d, want 200", path, rec.Code)
+		}
+	}
+
+	// Reads stay open to any authenticated caller
+	if rec := doRequest(handler, "GET", john, "", customer); rec.Code != http.StatusOK {
+		t.Errorf("GET %s as customer = %d, want 200", john, rec.Code)
+	}
+}
+
+func TestCombinedLogIncludesAuthenticatedUser(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"JWT_SECRET": "test-secret",
+		"LOG_STYLE":  "combined",
+	})
+	handler := us.Handler()
+	var logs bytes.Buffer
+	us.logger.SetOutput(&logs)
+
+	adminID := userIDByName(t, us, "admin")
+	if rec := doRequest(handler, "GET", "/users", "", bearerFor(t, "test-secret", adminID, "admin")); rec.Code != http.StatusOK {
+		t.Fatalf("GET /users = %d, want 200", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /users without a token = %d, want 401", rec.Code)
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("parsing log line %q: %v", line, err)
+		}
+		if entry["msg"] == "Request handled" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d access log lines, want 2:\n%s", len(entries), logs.String())
+	}
+	if got := entries[0]["user"]; got != adminID {
+		t.Errorf("authenticated request logged user %v, want %q", got, adminID)
+	}
+	if _, ok := entries[1]["user"]; ok {
+		t.Errorf("anonymous request logged user %v, want none", entries[1]["user"])
+	}
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"JWT_SECRET":     "test-secret",
+		"ROLE_HIERARCHY": "admin > writer > reader",
+		"RATE_LIMIT_RPS": "0",
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		caller, required string
+		want             int
+	}{
+		{"admin", "writer", http.StatusOK},
+		{"admin", "reader", http.StatusOK},
+		{"writer", "writer", http.StatusOK},
+		{"writer", "reader", http.StatusOK},
+		{"writer", "admin", http.StatusForbidden},
+		{"reader", "writer", http.StatusForbidden},
+		{"auditor", "reader", http.StatusForbidden},
+		{"admin", "auditor", http.StatusForbidden},
+		{"auditor", "auditor", http.StatusOK},
+	}
+	for _, tt := range tests {
+		handler := us.authMiddleware(us.requireRole(tt.required)(ok))
+		rec := doRequest(handler, "GET", "/users", "", bearerFor(t, "test-secret", "someone", tt.caller))
+		if rec.Code != tt.want {
+			t.Errorf("%s on a %s check = %d, want %d", tt.caller, tt.required, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestDefaultRoleHierarchyLetsAdminsPassCustomerChecks(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"JWT_SECRET": "test-secret"})
+	if !us.hasRole("admin", "customer") {
+		t.Error("admin does not satisfy a customer check")
+	}
+	if us.hasRole("customer", "admin") {
+		t.Error("customer satisfies an admin check")
+	}
+}
+
+func TestParseRoleHierarchy(t *testing.T) {
+	ranks, err := parseRoleHierarchy("admin>customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranks["admin"] <= ranks["customer"] {
+		t.Errorf("ranks = %v, want admin above customer", ranks)
+	}
+
+	for _, value := range []string{"", "admin>>customer", "admin>customer>admin"} {
+		if _, err := parseRoleHierarchy(value); err == nil {
+			t.Errorf("parseRoleHierarchy(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	secret := []byte("test-secret")
+	const now = int64(1700000000)
+	sign := func(claims jwtClaims) string {
+		token, err := signToken(claims, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := sign(jwtClaims{Subject: "u1", Role: "admin", ExpiresAt: now + 60})
+	claims, err := parseToken(valid, secret, now)
+	if err != nil || claims.Subject != "u1" || claims.Role != "admin" {
+		t.Fatalf("valid token = %+v, %v", claims, err)
+	}
+
+	parts := strings.Split(valid, ".")
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1","role":"admin","exp":9999999999}`))
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", sign(jwtClaims{Subject: "u1", ExpiresAt: now - 1}), errTokenExpired},
+		{"expiring this second", sign(jwtClaims{Subject: "u1", ExpiresAt: now}), errTokenExpired},
+		{"not yet valid", sign(jwtClaims{Subject: "u1", ExpiresAt: now + 60, NotBefore: now + 30}), errTokenNotYet},
+		{"without expiry", sign(jwtClaims{Subject: "u1"}), errTokenMalformed},
+		{"other secret", func() string { token, _ := signToken(jwtClaims{ExpiresAt: now + 60}, []byte("other")); return token }(), errTokenSignature},
+		{"tampered payload", parts[0] + "." + forgedPayload + "." + parts[2], errTokenSignature},
+		{"alg none", noneHeader + "." + parts[1] + ".", errTokenMalformed},
+		{"two parts", parts[0] + "." + parts[1], errTokenMalformed},
+		{"bad base64", parts[0] + "." + parts[1] + ".!!!", errTokenMalformed},
+	}
+	for _, tt := range tests {
+		if _, err := parseToken(tt.token, secret, now); err != tt.want {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestExpiredTokenIsRejectedWith401(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"JWT_SECRET": "test-secret", "RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	expired, err := signToken(jwtClaims{Subject: "u1", Role: "admin", ExpiresAt: time.Now().Add(-time.Minute).Unix()}, []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := doRequest(handler, "GET", "/users", "", map[string]string{"Authorization": "Bearer " + expired})
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusUnauthorized || body["error"] != "Token expired" {
+		t.Errorf("expired token = %d %v, want 401 Token expired", rec.Code, body)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 has no WWW-Authenticate challenge")
+	}
+
+	if rec := doRequest(handler, "GET", "/users", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token = %d, want 401", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/health", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /health without a token = %d, want 200", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users", "", bearerFor(t, "test-secret", "u1", "customer")); rec.Code != http.StatusOK {
+		t.Errorf("valid token = %d, want 200", rec.Code)
+	}
+}
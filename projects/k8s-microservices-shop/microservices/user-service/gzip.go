@@ -0,0 +1,152 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMiddleware compresses responses for clients accepting gzip. Bodies are
+// held back until minSize bytes have been written, so small responses go out
+// uncompressed. Paths in skip (e.g. the metrics endpoint, which negotiates
+// its own encoding) are passed through untouched.
+func gzipMiddleware(minSize int, skip map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The response depends on Accept-Encoding whether or not this
+			// particular one ends up compressed
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize, status: http.StatusOK}
+			defer gw.Close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip with a
+// non-zero quality. An entry naming gzip takes precedence over "*", so
+// "gzip;q=0, *" refuses gzip.
+func acceptsGzip(header string) bool {
+	gzipListed, gzipOK := false, false
+	starListed, starOK := false, false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip":
+			gzipListed, gzipOK = true, nonZeroQuality(params)
+		case "*":
+			starListed, starOK = true, nonZeroQuality(params)
+		}
+	}
+	if gzipListed {
+		return gzipOK
+	}
+	return starListed && starOK
+}
+
+// nonZeroQuality reports whether the parameters of an Accept-Encoding entry
+// leave it acceptable; an entry without a q parameter has quality 1
+func nonZeroQuality(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return err != nil || quality != 0
+	}
+	return true
+}
+
+// gzipResponseWriter buffers the start of a body until it is known to be
+// large enough to compress, then streams the rest through a gzip.Writer
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize     int
+	status      int
+	wroteHeader bool
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.status = code
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	gw.wroteHeader = true
+	switch {
+	case gw.gz != nil:
+		return gw.gz.Write(b)
+	case gw.passthrough:
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) < gw.minSize {
+		return len(b), nil
+	}
+	if err := gw.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// start commits to compressing, or to passing through when the handler set
+// its own encoding or the status has no body, and writes the buffered bytes
+func (gw *gzipResponseWriter) start() error {
+	header := gw.Header()
+	if header.Get("Content-Encoding") != "" || gw.status == http.StatusNoContent || gw.status == http.StatusNotModified {
+		return gw.flushPassthrough()
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	_, err := gw.gz.Write(gw.buf)
+	gw.buf = nil
+	return err
+}
+
+// flushPassthrough sends the status and any buffered bytes as they are
+func (gw *gzipResponseWriter) flushPassthrough() error {
+	gw.passthrough = true
+	gw.ResponseWriter.WriteHeader(gw.status)
+	var err error
+	if len(gw.buf) > 0 {
+		_, err = gw.ResponseWriter.Write(gw.buf)
+	}
+	gw.buf = nil
+	return err
+}
+
+// Close finishes the response: a body that stayed under the threshold is
+// written uncompressed, a compressed one gets its gzip trailer
+func (gw *gzipResponseWriter) Close() error {
+	switch {
+	case gw.gz != nil:
+		return gw.gz.Close()
+	case gw.passthrough:
+		return nil
+	case gw.wroteHeader:
+		return gw.flushPassthrough()
+	}
+	return nil
+}
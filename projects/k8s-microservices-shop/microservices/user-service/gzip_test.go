@@ -0,0 +1,83 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"br", false},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"*, gzip;q=0", false},
+		{"gzip, *;q=0", true},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipCompressesLargeResponses(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", us.getUsersHandler)
+	mux.HandleFunc("/health", us.healthHandler)
+	mux.HandleFunc("/metrics", us.getUsersHandler)
+	handler := gzipMiddleware(256, map[string]bool{"/metrics": true})(mux)
+	acceptGzip := map[string]string{"Accept-Encoding": "gzip"}
+
+	rec := doRequest(handler, "GET", "/users", "", acceptGzip)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("opening gzip body: %v", err)
+	}
+	var page userPage
+	if err := json.NewDecoder(reader).Decode(&page); err != nil {
+		t.Fatalf("decoding gzip body: %v", err)
+	}
+	if page.Total != 3 {
+		t.Errorf("decoded %d users, want 3", page.Total)
+	}
+
+	// Small bodies and skipped paths go out as they are
+	rec = doRequest(handler, "GET", "/health", "", acceptGzip)
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("GET /health Content-Encoding = %q, want none", got)
+	}
+	rec = doRequest(handler, "GET", "/metrics", "", acceptGzip)
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("GET /metrics Content-Encoding = %q, want none", got)
+	}
+
+	// An explicit refusal of gzip beats the wildcard
+	for _, header := range []string{"gzip;q=0", "gzip;q=0, *"} {
+		rec = doRequest(handler, "GET", "/users", "", map[string]string{"Accept-Encoding": header})
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("GET /users with %q Content-Encoding = %q, want none", header, got)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tokenBucket is a token bucket refilled lazily whenever a token is taken.
+// It is not safe for concurrent use; callers hold their own lock.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take refills the bucket for the time elapsed since the last call and
+// consumes a token, reporting false when none is available
+func (tb *tokenBucket) take(now time.Time) bool {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// retryAfter is how long until the bucket next holds a whole token
+func (tb *tokenBucket) retryAfter() time.Duration {
+	if tb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// idleFor reports whether the bucket has refilled completely by now, at
+// which point it is indistinguishable from a fresh one
+func (tb *tokenBucket) idleFor(now time.Time) bool {
+	return tb.tokens+now.Sub(tb.last).Seconds()*tb.rate >= tb.burst
+}
+
+// rateLimitedListener caps the rate at which new connections are accepted.
+// Connections arriving while the bucket is empty are closed immediately.
+type rateLimitedListener struct {
+	net.Listener
+	mutex    sync.Mutex
+	bucket   *tokenBucket
+	rejected prometheus.Counter
+}
+
+func newRateLimitedListener(l net.Listener, rate float64, burst int, rejected prometheus.Counter) *rateLimitedListener {
+	return &rateLimitedListener{
+		Listener: l,
+		bucket:   newTokenBucket(rate, burst),
+		rejected: rejected,
+	}
+}
+
+// Accept returns the next connection allowed by the rate limit
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		l.mutex.Lock()
+		allowed := l.bucket.take(time.Now())
+		l.mutex.Unlock()
+
+		if allowed {
+			return conn, nil
+		}
+
+		conn.Close()
+		l.rejected.Inc()
+	}
+}
+
+// countingListener wraps accepted connections so the bytes they read and
+// write are added to the connection byte counters
+type countingListener struct {
+	net.Listener
+	bytes *prometheus.CounterVec
+}
+
+func newCountingListener(l net.Listener, bytes *prometheus.CounterVec) *countingListener {
+	return &countingListener{Listener: l, bytes: bytes}
+}
+
+// Accept returns the next connection wrapped for byte accounting
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingConn{
+		Conn:    conn,
+		read:    l.bytes.WithLabelValues("read"),
+		written: l.bytes.WithLabelValues("written"),
+	}, nil
+}
+
+// countingConn counts the bytes passing through a connection
+type countingConn struct {
+	net.Conn
+	read    prometheus.Counter
+	written prometheus.Counter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// pipeListener hands out the server ends of in-memory connections
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn, 16)}
+}
+
+// dial queues a connection for Accept and returns its client end
+func (l *pipeListener) dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestCountingConnCountsBothDirections(t *testing.T) {
+	bytes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "conn_bytes_total"}, []string{"direction"})
+	pipe := newPipeListener()
+	listener := newCountingListener(pipe, bytes)
+
+	client := pipe.dial()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("hello"))
+		io.ReadAll(client)
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("world!")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := testutil.ToFloat64(bytes.WithLabelValues("read")); got != 5 {
+		t.Errorf("bytes read = %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(bytes.WithLabelValues("written")); got != 6 {
+		t.Errorf("bytes written = %v, want 6", got)
+	}
+}
+
+func TestRateLimitedListenerRejectsAcceptFlood(t *testing.T) {
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{Name: "conns_rejected_total"})
+	pipe := newPipeListener()
+	// Effectively no refill during the test, so only the burst gets through
+	listener := newRateLimitedListener(pipe, 0.001, 2, rejected)
+
+	var clients []net.Conn
+	for i := 0; i < 5; i++ {
+		clients = append(clients, pipe.dial())
+	}
+	pipe.Close()
+
+	accepted := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		accepted++
+		defer conn.Close()
+	}
+
+	if accepted != 2 {
+		t.Errorf("accepted %d connections, want the burst of 2", accepted)
+	}
+	if got := testutil.ToFloat64(rejected); got != 3 {
+		t.Errorf("rejected = %v, want 3", got)
+	}
+
+	// Rejected connections are closed rather than left hanging
+	for _, client := range clients[2:] {
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read on a rejected connection = %v, want EOF", err)
+		}
+	}
+}
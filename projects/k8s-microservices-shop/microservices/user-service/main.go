@@ -1,62 +1,387 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // User represents a user in the system
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	Role     string `json:"role"`
-	Created  string `json:"created"`
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	DisplayName   string `json:"display_name"` // empty unless set explicitly
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
+	Created       string `json:"created"`
+	Updated       string `json:"updated"`
+}
+
+// UnmarshalJSON decodes a user, also accepting the integer IDs of records
+// written before IDs became UUIDs. Those keep their decimal form as their ID.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plainUser User
+	aux := struct {
+		*plainUser
+		ID json.RawMessage `json:"id"`
+	}{plainUser: (*plainUser)(u)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	u.ID = ""
+	if len(aux.ID) == 0 || string(aux.ID) == "null" {
+		return nil
+	}
+	if aux.ID[0] == '"' {
+		return json.Unmarshal(aux.ID, &u.ID)
+	}
+
+	var legacyID int64
+	if err := json.Unmarshal(aux.ID, &legacyID); err != nil {
+		return err
+	}
+	u.ID = strconv.FormatInt(legacyID, 10)
+	return nil
+}
+
+// lessUser orders users oldest first, breaking ties by ID, so listings are
+// stable even though IDs are random
+func lessUser(a, b User) bool {
+	if a.Created != b.Created {
+		return a.Created < b.Created
+	}
+	return a.ID < b.ID
+}
+
+// displayName is the name to show for u: its display name, or its name when
+// no display name was set
+func (u User) displayName() string {
+	if u.DisplayName == "" {
+		return u.Name
+	}
+	return u.DisplayName
+}
+
+// presented is u as clients see it. Defaults are filled in here rather than
+// stored, so a user without a display name keeps following name changes.
+func (u User) presented() User {
+	u.DisplayName = u.displayName()
+	return u
+}
+
+// openAPISpec is the hand-maintained OpenAPI 3 description of the routes.
+// Update openapi.json whenever a route, parameter or response changes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// commit is the VCS revision the binary was built from, set at build time
+// with -ldflags "-X main.commit=<sha>"
+var commit = "unknown"
+
+// clock abstracts the time source so tests can use a fixed time
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock reports the current time in UTC
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// validRoles are the roles a user may have
+var validRoles = map[string]bool{
+	"admin":    true,
+	"customer": true,
+}
+
+// emailPattern is a pragmatic subset of RFC 5322 addresses: a dot-atom local
+// part and a domain with at least one dot
+var emailPattern = regexp.MustCompile(`^[a-zA-Z0-9.!#$%&'*+/=?^_{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)+$`)
+
+// validationError reports the user field that failed validation
+type validationError struct {
+	Field   string
+	Message string
+}
+
+func (e *validationError) Error() string {
+	return e.Message
+}
+
+// requirableUserFields are the fields REQUIRED_USER_FIELDS may name
+var requirableUserFields = []string{"username", "email", "name"}
+
+// defaultRequiredUserFields is used when REQUIRED_USER_FIELDS is unset
+const defaultRequiredUserFields = "username,email"
+
+// validateUser checks the client-supplied fields of a user. Every field must
+// be valid UTF-8. Fields in required must be non-blank; optional ones may be
+// empty, but an email that is given must still be valid.
+func validateUser(u User, required map[string]bool) error {
+	for _, field := range []struct{ name, value string }{
+		{"username", u.Username},
+		{"email", u.Email},
+		{"name", u.Name},
+		{"display_name", u.DisplayName},
+		{"role", u.Role},
+	} {
+		if !utf8.ValidString(field.value) {
+			return &validationError{Field: field.name, Message: field.name + " must be valid UTF-8"}
+		}
+	}
+
+	values := map[string]string{"username": u.Username, "email": u.Email, "name": u.Name}
+	for _, field := range requirableUserFields {
+		if required[field] && strings.TrimSpace(values[field]) == "" {
+			return &validationError{Field: field, Message: strings.ToUpper(field[:1]) + field[1:] + " is required"}
+		}
+	}
+	if u.Email != "" && !emailPattern.MatchString(u.Email) {
+		return &validationError{Field: "email", Message: "Email is invalid"}
+	}
+	if !validRoles[u.Role] {
+		return &validationError{Field: "role", Message: "Role must be admin or customer"}
+	}
+	return nil
+}
+
+// writeValidationError responds 400 with the message and offending field
+func writeValidationError(w http.ResponseWriter, err error) {
+	body := map[string]string{"error": err.Error()}
+	var validationErr *validationError
+	if errors.As(err, &validationErr) {
+		body["field"] = validationErr.Field
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(body)
 }
 
 // UserService handles user operations
 type UserService struct {
-	users     map[int]User
-	mutex     sync.RWMutex
-	redis     *redis.Client
-	logger    *logrus.Logger
-	requestsTotal *prometheus.CounterVec
-	requestDuration *prometheus.HistogramVec
+	users            map[string]User
+	mutex            sync.RWMutex
+	userLocks        [userLockStripes]sync.Mutex
+	redis            redis.UniversalClient
+	logger           *logrus.Logger
+	requestsTotal    *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	responsesByClass *prometheus.CounterVec
+	connsRejected    prometheus.Counter
+	connBytes        *prometheus.CounterVec
+	rateLimited      prometheus.Counter
+	panicsTotal      prometheus.Counter
+	requestsInFlight prometheus.Gauge
+	combinedLogs     bool
+	clock            clock
+	lastRemoval      time.Time
+	encodeBufferSize int
+	scanCount        int64
+	verifySecret     []byte
+	maxBodyBytes     int64
+	maxBulkSize      int
+	minUploadRate    float64
+	requiredFields   map[string]bool
+	maintenance      atomic.Bool
+	draining         atomic.Bool
+	loaded           atomic.Bool
+	inFlight         atomic.Int64
+	heartbeat        atomic.Int64
+	heartbeatEvery   time.Duration
+	heartbeatTimeout time.Duration
+	jwtSecret        []byte
+	foldUsernames    bool
+	roleRanks        map[string]int
+	publicPaths      map[string]bool
+	trustedProxies   []*net.IPNet
+	quietPaths       map[string]bool
+	config           handlerConfig
+	rateLimiter      *ipRateLimiter
+	bulkSlots        chan struct{}
+	stopBackground   context.CancelFunc
+	background       sync.WaitGroup
+	registerer       prometheus.Registerer
+	gatherer         prometheus.Gatherer
 }
 
-// NewUserService creates a new user service
-func NewUserService() *UserService {
+// NewUserService creates a new user service. Its metrics are registered with
+// registerer and served from gatherer, so an application embedding the
+// service can give it a registry of its own; main passes the Prometheus
+// defaults. It returns an error when the handler configuration is invalid.
+func NewUserService(registerer prometheus.Registerer, gatherer prometheus.Gatherer) (*UserService, error) {
+	config, err := loadHandlerConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.InfoLevel)
+	configureLogOutput(logger, getEnv("LOG_OUTPUT", "stderr"))
+
+	// Access log style: "split" logs request start and completion separately,
+	// "combined" logs a single summary line once the request completes
+	logStyle := getEnv("LOG_STYLE", "split")
+	if logStyle != "split" && logStyle != "combined" {
+		logger.WithField("log_style", logStyle).Warn("Unknown LOG_STYLE, using split")
+		logStyle = "split"
+	}
+
+	// Size of the write buffer used when encoding user lists, 0 disables it
+	encodeBufferSize, err := strconv.Atoi(getEnv("ENCODE_BUFFER_SIZE", "32768"))
+	if err != nil || encodeBufferSize < 0 {
+		logger.WithField("value", getEnv("ENCODE_BUFFER_SIZE", "")).Warn("Invalid ENCODE_BUFFER_SIZE, using 32768")
+		encodeBufferSize = 32768
+	}
+
+	// COUNT hint for each SCAN call when listing keys: higher values mean
+	// fewer round trips but longer individual calls on Redis
+	scanCount, err := strconv.ParseInt(getEnv("REDIS_SCAN_COUNT", "100"), 10, 64)
+	if err != nil || scanCount <= 0 {
+		logger.WithField("value", getEnv("REDIS_SCAN_COUNT", "")).Warn("Invalid REDIS_SCAN_COUNT, using 100")
+		scanCount = 100
+	}
+
+	// Upper bound on request body size
+	maxBodyBytes, err := strconv.ParseInt(getEnv("MAX_BODY_BYTES", "1048576"), 10, 64)
+	if err != nil || maxBodyBytes <= 0 {
+		logger.WithField("value", getEnv("MAX_BODY_BYTES", "")).Warn("Invalid MAX_BODY_BYTES, using 1048576")
+		maxBodyBytes = 1048576
+	}
+
+	// Most users one batch create may hold
+	maxBulkSize, err := strconv.Atoi(getEnv("MAX_BULK_SIZE", strconv.Itoa(maxBatchSize)))
+	if err != nil || maxBulkSize <= 0 {
+		logger.WithField("value", getEnv("MAX_BULK_SIZE", "")).Warn("Invalid MAX_BULK_SIZE, using " + strconv.Itoa(maxBatchSize))
+		maxBulkSize = maxBatchSize
+	}
+
+	// Slowest acceptable request body upload in bytes per second, 0 disables
+	// the check
+	minUploadRate, err := strconv.ParseFloat(getEnv("MIN_UPLOAD_RATE", "0"), 64)
+	if err != nil || minUploadRate < 0 {
+		logger.WithField("value", getEnv("MIN_UPLOAD_RATE", "")).Warn("Invalid MIN_UPLOAD_RATE, disabling the upload rate check")
+		minUploadRate = 0
+	}
+
+	// User fields that must be non-blank on create and update
+	requiredFields := make(map[string]bool)
+	for _, field := range splitList(getEnv("REQUIRED_USER_FIELDS", defaultRequiredUserFields)) {
+		field = strings.ToLower(field)
+		valid := false
+		for _, requirable := range requirableUserFields {
+			valid = valid || field == requirable
+		}
+		if !valid {
+			logger.WithField("field", field).Warn("Ignoring unknown field in REQUIRED_USER_FIELDS")
+			continue
+		}
+		requiredFields[field] = true
+	}
+
+	// Role ordering, highest first; a role satisfies checks for every role
+	// below it
+	roleRanks, err := parseRoleHierarchy(getEnv("ROLE_HIERARCHY", defaultRoleHierarchy))
+	if err != nil {
+		logger.WithError(err).WithField("value", getEnv("ROLE_HIERARCHY", "")).Warn("Invalid ROLE_HIERARCHY, using " + defaultRoleHierarchy)
+		roleRanks, _ = parseRoleHierarchy(defaultRoleHierarchy)
+	}
+
+	// Latency histogram buckets in seconds, e.g. "0.0005,0.001,0.005,0.01"
+	durationBuckets := prometheus.DefBuckets
+	if value := getEnv("HISTOGRAM_BUCKETS", ""); value != "" {
+		if buckets, err := parseBuckets(value); err != nil {
+			logger.WithError(err).WithField("value", value).Warn("Invalid HISTOGRAM_BUCKETS, using default buckets")
+		} else {
+			durationBuckets = buckets
+		}
+	}
+	logger.WithField("buckets", durationBuckets).Info("Request duration histogram buckets configured")
+
+	// The liveness heartbeat is refreshed every HEARTBEAT_INTERVAL; /health
+	// fails once it is older than HEARTBEAT_TIMEOUT
+	heartbeatEvery, err := time.ParseDuration(getEnv("HEARTBEAT_INTERVAL", "5s"))
+	if err != nil || heartbeatEvery <= 0 {
+		logger.WithField("value", getEnv("HEARTBEAT_INTERVAL", "")).Warn("Invalid HEARTBEAT_INTERVAL, using 5s")
+		heartbeatEvery = 5 * time.Second
+	}
+	heartbeatTimeout, err := time.ParseDuration(getEnv("HEARTBEAT_TIMEOUT", "30s"))
+	if err != nil || heartbeatTimeout <= heartbeatEvery {
+		logger.WithField("value", getEnv("HEARTBEAT_TIMEOUT", "")).Warn("Invalid HEARTBEAT_TIMEOUT, using six heartbeat intervals")
+		heartbeatTimeout = 6 * heartbeatEvery
+	}
+
+	// Proxies whose X-Forwarded-For / X-Real-IP headers are believed, e.g.
+	// the ingress controller's pod CIDR. Empty trusts no one, so clients are
+	// identified by their connection's address.
+	trustedProxies, invalidProxies := parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	if len(invalidProxies) > 0 {
+		logger.WithField("entries", invalidProxies).Warn("Ignoring invalid TRUSTED_PROXIES entries")
+	}
+
+	// Redis logical database, lets services sharing one Redis keep their
+	// keys apart
+	redisDB, err := strconv.Atoi(getEnv("REDIS_DB", "0"))
+	if err != nil || redisDB < 0 {
+		logger.WithField("value", getEnv("REDIS_DB", "")).Warn("Invalid REDIS_DB, using 0")
+		redisDB = 0
+	}
+	if redisDB != 0 && len(redisClusterAddrs()) > 0 {
+		logger.WithField("redis_db", redisDB).Warn("REDIS_DB is ignored in cluster mode, which only has database 0")
+	}
 
 	// Initialize Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     getEnv("REDIS_URL", "redis:6379"),
-		Password: getEnv("REDIS_PASSWORD", ""),
-		DB:       0,
-	})
+	redisClient := newRedisClient(redisDB)
 
-	// Initialize Prometheus metrics
+	// Initialize Prometheus metrics. METRICS_PREFIX (e.g. "userservice_") is
+	// prepended to every name so services can share a Prometheus without
+	// collisions; it defaults to empty, keeping the existing names.
+	metricsPrefix := getEnv("METRICS_PREFIX", "")
 	requestsTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "http_requests_total",
+			Name: metricsPrefix + "http_requests_total",
 			Help: "Total number of HTTP requests",
 		},
 		[]string{"method", "endpoint", "status"},
@@ -64,53 +389,335 @@ func NewUserService() *UserService {
 
 	requestDuration := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
+			Name:    metricsPrefix + "http_request_duration_seconds",
 			Help:    "HTTP request duration in seconds",
-			Buckets: prometheus.DefBuckets,
+			Buckets: durationBuckets,
 		},
 		[]string{"method", "endpoint"},
 	)
 
-	prometheus.MustRegister(requestsTotal, requestDuration)
+	responsesByClass := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "http_responses_by_class_total",
+			Help: "Total number of HTTP responses by status code class",
+		},
+		[]string{"class"},
+	)
+
+	connsRejected := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "connections_rejected_total",
+			Help: "Total number of connections closed by the accept rate limit",
+		},
+	)
+
+	connBytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "connection_bytes_total",
+			Help: "Total number of bytes read from and written to client connections",
+		},
+		[]string{"direction"},
+	)
+
+	rateLimited := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "rate_limited_total",
+			Help: "Total number of requests rejected by the per-client rate limit",
+		},
+	)
+
+	panicsTotal := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "panics_total",
+			Help: "Total number of handler panics recovered",
+		},
+	)
+
+	requestsInFlight := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: metricsPrefix + "http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served",
+		},
+	)
+
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricsPrefix + "build_info",
+			Help: "Build information, always 1, labeled by version, commit and Go version",
+		},
+		[]string{"version", "commit", "goversion"},
+	)
+	buildInfo.WithLabelValues(getEnv("SERVICE_VERSION", "1.0.0"), commit, runtime.Version()).Set(1)
+
+	registerer.MustRegister(requestsTotal, requestDuration, responsesByClass, connsRejected, connBytes, rateLimited, panicsTotal, requestsInFlight, buildInfo)
 
 	service := &UserService{
-		users:           make(map[int]User),
-		redis:           redisClient,
-		logger:          logger,
-		requestsTotal:   requestsTotal,
-		requestDuration: requestDuration,
+		users:            make(map[string]User),
+		redis:            redisClient,
+		logger:           logger,
+		requestsTotal:    requestsTotal,
+		requestDuration:  requestDuration,
+		responsesByClass: responsesByClass,
+		connsRejected:    connsRejected,
+		connBytes:        connBytes,
+		rateLimited:      rateLimited,
+		panicsTotal:      panicsTotal,
+		requestsInFlight: requestsInFlight,
+		combinedLogs:     logStyle == "combined",
+		clock:            systemClock{},
+		encodeBufferSize: encodeBufferSize,
+		scanCount:        scanCount,
+		verifySecret:     []byte(getEnv("EMAIL_VERIFICATION_SECRET", "")),
+		maxBodyBytes:     maxBodyBytes,
+		maxBulkSize:      maxBulkSize,
+		minUploadRate:    minUploadRate,
+		requiredFields:   requiredFields,
+		jwtSecret:        []byte(getEnv("JWT_SECRET", "")),
+		roleRanks:        roleRanks,
+		foldUsernames:    getEnv("USERNAME_CASE_INSENSITIVE", "false") == "true",
+		heartbeatEvery:   heartbeatEvery,
+		heartbeatTimeout: heartbeatTimeout,
+		trustedProxies:   trustedProxies,
+		config:           config,
+		registerer:       registerer,
+		gatherer:         gatherer,
+	}
+
+	// Probes and scrapes arrive every few seconds, so their access logs are
+	// dropped unless LOG_PROBES=true. QUIET_LOG_PATHS overrides which paths
+	// that covers.
+	if getEnv("LOG_PROBES", "false") != "true" {
+		quiet := splitList(getEnv("QUIET_LOG_PATHS", strings.Join([]string{config.healthPath, config.readyPath, config.metricsPath}, ",")))
+		service.quietPaths = make(map[string]bool, len(quiet))
+		for _, path := range quiet {
+			service.quietPaths[path] = true
+		}
+		logger.WithField("paths", quiet).Info("Access logs suppressed for probe paths")
+	}
+
+	// Probes, scrapes and the API description stay reachable without a token
+	service.publicPaths = map[string]bool{config.healthPath: true, config.readyPath: true, config.metricsPath: true, "/openapi.json": true}
+	if len(service.jwtSecret) == 0 {
+		logger.Warn("JWT_SECRET is not set, authentication is disabled")
+	}
+
+	if config.rateLimit > 0 {
+		service.rateLimiter = newIPRateLimiter(config.rateLimit, config.rateBurst, rateLimited)
+		logger.WithFields(logrus.Fields{
+			"rate":  config.rateLimit,
+			"burst": config.rateBurst,
+		}).Info("Request rate limit enabled")
+	}
+	if config.maxBulk > 0 {
+		service.bulkSlots = make(chan struct{}, config.maxBulk)
+	}
+	if len(config.allowedOrigins) > 0 {
+		logger.WithField("origins", config.allowedOrigins).Info("CORS restricted to allowed origins")
+	}
+	if len(config.deprecated) > 0 {
+		logger.WithField("endpoints", config.deprecated).Info("Deprecation headers enabled")
+	}
+	if config.metricsToken != "" {
+		logger.Info("Metrics endpoint requires a token")
+	}
+	if config.readOnly {
+		logger.Info("Read-only mode enabled, write endpoints disabled")
+	}
+
+	service.maintenance.Store(getEnv("MAINTENANCE_MODE", "false") == "true")
+	service.heartbeat.Store(service.clock.Now().UnixNano())
+
+	// Load users from Redis. While it is unreachable the service stays not
+	// ready and keeps retrying instead of serving made-up data.
+	var backgroundCtx context.Context
+	backgroundCtx, service.stopBackground = context.WithCancel(context.Background())
+	if err := service.initializeData(backgroundCtx); err != nil {
+		service.logger.WithError(err).Error("Failed to load users from Redis, retrying in the background")
+		service.background.Add(1)
+		go service.retryInitializeData(backgroundCtx)
+	}
+
+	return service, nil
+}
+
+// Close stops the service's background work, waiting for it to finish, and
+// closes its Redis client. The service must not be used afterwards.
+func (us *UserService) Close() error {
+	us.stopBackground()
+	us.background.Wait()
+	return us.redis.Close()
+}
+
+// metricsHandler serves the metrics of the registry the service was created
+// with, instrumented the same way as promhttp.Handler
+func (us *UserService) metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(us.registerer, promhttp.HandlerFor(us.gatherer, promhttp.HandlerOpts{}))
+}
+
+// configureLogOutput points the logger at stdout, stderr or an append-only
+// file given as "file:<path>". Unknown or unusable destinations fall back to
+// stderr with a warning.
+func configureLogOutput(logger *logrus.Logger, output string) {
+	switch {
+	case output == "stdout":
+		logger.SetOutput(os.Stdout)
+	case output == "stderr":
+		logger.SetOutput(os.Stderr)
+	case strings.HasPrefix(output, "file:"):
+		path := strings.TrimPrefix(output, "file:")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.SetOutput(os.Stderr)
+			logger.WithError(err).WithField("path", path).Warn("Cannot open log file, logging to stderr")
+			return
+		}
+		logger.SetOutput(file)
+	default:
+		logger.SetOutput(os.Stderr)
+		logger.WithField("log_output", output).Warn("Unknown LOG_OUTPUT, logging to stderr")
+	}
+}
+
+// redisClusterAddrs returns the node addresses of a Redis cluster: those in
+// REDIS_CLUSTER_ADDRS, or, with REDIS_CLUSTER=true, the comma-separated
+// REDIS_URL. It returns nil for a single node.
+func redisClusterAddrs() []string {
+	if addrs := splitList(getEnv("REDIS_CLUSTER_ADDRS", "")); len(addrs) > 0 {
+		return addrs
 	}
+	if getEnv("REDIS_CLUSTER", "false") == "true" {
+		return splitList(getEnv("REDIS_URL", "redis:6379"))
+	}
+	return nil
+}
 
-	// Initialize with sample data
-	service.initializeData()
+// newRedisClient connects to a single Redis node, or to a Redis cluster when
+// redisClusterAddrs lists its nodes. Both satisfy redis.UniversalClient.
+func newRedisClient(db int) redis.UniversalClient {
+	password := getEnv("REDIS_PASSWORD", "")
 
-	return service
+	if addrs := redisClusterAddrs(); len(addrs) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: password,
+		})
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:     getEnv("REDIS_URL", "redis:6379"),
+		Password: password,
+		DB:       db,
+	})
 }
 
-// initializeData loads sample users
-func (us *UserService) initializeData() {
+// initializeData hydrates the in-memory cache from Redis, which is the source
+// of truth, and seeds sample users only when Redis holds none. A load error
+// is returned as is: seeding then would hide the real users and let creates
+// reuse their usernames and emails.
+func (us *UserService) initializeData(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	users, err := us.loadUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		if err := us.rebuildIndexes(ctx, users); err != nil {
+			us.logger.WithError(err).Warn("Failed to rebuild user indexes")
+		}
+
+		us.mutex.Lock()
+		us.users = users
+		us.mutex.Unlock()
+		us.loaded.Store(true)
+		us.logger.WithField("count", len(users)).Info("Hydrated users from Redis")
+		return nil
+	}
+
+	now := us.clock.Now()
+	timestamp := now.Format(time.RFC3339)
 	sampleUsers := []User{
-		{ID: 1, Username: "admin", Email: "admin@shop.com", Name: "Administrator", Role: "admin", Created: time.Now().Format(time.RFC3339)},
-		{ID: 2, Username: "john_doe", Email: "john@example.com", Name: "John Doe", Role: "customer", Created: time.Now().Format(time.RFC3339)},
-		{ID: 3, Username: "jane_smith", Email: "jane@example.com", Name: "Jane Smith", Role: "customer", Created: time.Now().Format(time.RFC3339)},
+		{ID: newUUID(), Username: "admin", Email: "admin@shop.com", Name: "Administrator", Role: "admin", Created: timestamp, Updated: timestamp},
+		{ID: newUUID(), Username: "john_doe", Email: "john@example.com", Name: "John Doe", Role: "customer", Created: timestamp, Updated: timestamp},
+		{ID: newUUID(), Username: "jane_smith", Email: "jane@example.com", Name: "Jane Smith", Role: "customer", Created: timestamp, Updated: timestamp},
+	}
+
+	for _, user := range sampleUsers {
+		if err := us.saveUser(ctx, user, User{}); err != nil {
+			us.logger.WithError(err).WithField("user_id", user.ID).Warn("Failed to persist sample user")
+		}
 	}
 
+	us.mutex.Lock()
 	for _, user := range sampleUsers {
 		us.users[user.ID] = user
 	}
+	us.mutex.Unlock()
+	us.loaded.Store(true)
 
 	us.logger.Info("Initialized user service with sample data")
+	return nil
+}
+
+// maxLoadRetryDelay caps the backoff between attempts to load users
+const maxLoadRetryDelay = 30 * time.Second
+
+// retryInitializeData keeps trying to load users, backing off exponentially,
+// until it succeeds or ctx is cancelled
+func (us *UserService) retryInitializeData(ctx context.Context) {
+	defer us.background.Done()
+
+	delay := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := us.initializeData(ctx)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delay = min(2*delay, maxLoadRetryDelay)
+		us.logger.WithError(err).WithField("retry_in", delay.String()).Warn("Failed to load users from Redis")
+	}
+}
+
+// Serve the embedded OpenAPI spec
+func (us *UserService) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
 }
 
 // Health check handler
 func (us *UserService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	status := "200"
 	defer func() {
 		duration := time.Since(start).Seconds()
 		us.requestDuration.WithLabelValues(r.Method, "/health").Observe(duration)
-		us.requestsTotal.WithLabelValues(r.Method, "/health", "200").Inc()
+		us.requestsTotal.WithLabelValues(r.Method, "/health", status).Inc()
 	}()
 
+	// A stale heartbeat means the process is wedged and should be restarted
+	heartbeatAge := us.clock.Now().Sub(time.Unix(0, us.heartbeat.Load()))
+	if heartbeatAge > us.heartbeatTimeout {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":        "unhealthy",
+			"error":         "Heartbeat is stale",
+			"heartbeat_age": heartbeatAge.String(),
+		})
+		return
+	}
+
 	response := map[string]interface{}{
 		"status":    "healthy",
 		"service":   "user-service",
@@ -123,6 +730,25 @@ func (us *UserService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// runHeartbeat refreshes the liveness heartbeat until ctx is done. Each beat
+// briefly takes the users lock, so a handler stuck holding it stops the
+// heartbeat and /health starts failing.
+func (us *UserService) runHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(us.heartbeatEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			us.mutex.RLock()
+			us.mutex.RUnlock()
+			us.heartbeat.Store(us.clock.Now().UnixNano())
+		}
+	}
+}
+
 // Readiness check handler
 func (us *UserService) readyHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -133,11 +759,51 @@ func (us *UserService) readyHandler(w http.ResponseWriter, r *http.Request) {
 		us.requestsTotal.WithLabelValues(r.Method, "/ready", status).Inc()
 	}()
 
+	// Take the pod out of rotation as soon as shutdown starts, so it is
+	// removed from endpoints before it stops accepting connections
+	if us.draining.Load() {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "not ready",
+			"error":  "Shutting down",
+		})
+		return
+	}
+
+	// Nothing can be served until the users have been loaded from Redis
+	if !us.loaded.Load() {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "not ready",
+			"error":  "Users not loaded from Redis yet",
+		})
+		return
+	}
+
+	// Take the pod out of rotation while in maintenance
+	if us.maintenance.Load() {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "not ready",
+			"error":  "Maintenance mode",
+		})
+		return
+	}
+
 	// Check Redis connection
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
+	ctx, span := tracer.Start(ctx, "redis.ping")
 	_, err := us.redis.Ping(ctx).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "ping failed")
+	}
+	span.End()
 	if err != nil {
 		status = "503"
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -162,48 +828,1553 @@ func (us *UserService) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 		us.requestsTotal.WithLabelValues(r.Method, "/users", status).Inc()
 	}()
 
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
 	us.mutex.RLock()
 	defer us.mutex.RUnlock()
 
+	// The collection last changed when its most recently updated user did,
+	// or when a user was removed from it, whichever came later
+	lastModified := us.lastRemoval
 	var userList []User
 	for _, user := range us.users {
+		if !filter.matches(user) {
+			continue
+		}
 		userList = append(userList, user)
+		if updated, err := time.Parse(time.RFC3339, user.Updated); err == nil && updated.After(lastModified) {
+			lastModified = updated
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userList)
+	// HTTP dates have second precision, so compare at that granularity
+	lastModified = lastModified.Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		status = "304"
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	us.logger.WithFields(logrus.Fields{
-		"method": r.Method,
-		"path":   r.URL.Path,
-		"count":  len(userList),
+	// Map iteration order is random, so sort to keep pages stable
+	sort.Slice(userList, func(i, j int) bool {
+		return lessUser(userList[i], userList[j])
+	})
+
+	// An empty page must encode as [], not null
+	page := userPage{
+		Users:  []User{},
+		Total:  len(userList),
+		Limit:  limit,
+		Offset: offset,
+	}
+	if offset < len(userList) {
+		end := offset + limit
+		if end > len(userList) {
+			end = len(userList)
+		}
+		page.Users = userList[offset:end]
+	}
+
+	if err := writeNegotiatedBuffered(w, r, http.StatusOK, page, us.encodeBufferSize); err != nil {
+		us.requestLogger(r).WithError(err).Warn("Failed to write users response")
+	}
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"count":   len(page.Users),
+		"matched": page.Total,
+		"total":   len(us.users),
 	}).Info("Retrieved users")
 }
 
-// Get user by ID
-func (us *UserService) getUserHandler(w http.ResponseWriter, r *http.Request) {
+// exportFlushRows is how many streamed rows are written between flushes
+const exportFlushRows = 500
+
+// exportFormats are the formats the export endpoint can produce
+var exportFormats = map[string]bool{"csv": true, "ndjson": true, "json": true}
+
+// exportFormat picks the export format from ?format=, falling back to the
+// Accept header and then to CSV
+func exportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		format = strings.ToLower(format)
+		if !exportFormats[format] {
+			return "", errors.New("Invalid format, must be csv, ndjson or json")
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson", nil
+	case strings.Contains(accept, "application/json"):
+		return "json", nil
+	}
+	return "csv", nil
+}
+
+// Export users as CSV, NDJSON or a JSON array, honouring the same filters as
+// the list endpoint. CSV and NDJSON are streamed row by row; JSON is encoded
+// in one go since the array has to be complete to be valid.
+func (us *UserService) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	status := "200"
 	defer func() {
 		duration := time.Since(start).Seconds()
-		us.requestDuration.WithLabelValues(r.Method, "/users/{id}").Observe(duration)
-		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}", status).Inc()
+		us.requestDuration.WithLabelValues(r.Method, "/users/export").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/export", status).Inc()
 	}()
 
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.Atoi(idStr)
+	format, err := exportFormat(r)
 	if err != nil {
 		status = "400"
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	us.mutex.RLock()
-	user, exists := us.users[id]
-	us.mutex.RUnlock()
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Only the matching users are copied under the lock; rows are written
+	// after it is released so a slow client doesn't hold up writers
+	us.mutex.RLock()
+	userList := []User{}
+	for _, user := range us.users {
+		if filter.matches(user) {
+			userList = append(userList, user)
+		}
+	}
+	us.mutex.RUnlock()
+
+	sort.Slice(userList, func(i, j int) bool {
+		return lessUser(userList[i], userList[j])
+	})
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=users.csv")
+		err = writeUsersCSV(w, userList)
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=users.ndjson")
+		err = writeUsersNDJSON(w, userList)
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=users.json")
+		err = writeJSONBuffered(w, presentUsers(userList), us.encodeBufferSize)
+	}
+	if err != nil {
+		us.requestLogger(r).WithError(err).Warn("Failed to write users export")
+	}
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"format": format,
+		"count":  len(userList),
+	}).Info("Exported users")
+}
+
+// writeUsersCSV streams users as CSV with a header row
+func writeUsersCSV(w io.Writer, users []User) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"id", "username", "email", "name", "role", "created"}); err != nil {
+		return err
+	}
+	for i, user := range users {
+		if err := out.Write([]string{user.ID, user.Username, user.Email, user.Name, user.Role, user.Created}); err != nil {
+			return err
+		}
+		if (i+1)%exportFlushRows == 0 {
+			out.Flush()
+			if err := out.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeUsersNDJSON streams users as newline-delimited JSON, one per line
+func writeUsersNDJSON(w io.Writer, users []User) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	for i, user := range users {
+		if err := enc.Encode(user.presented()); err != nil {
+			return err
+		}
+		if (i+1)%exportFlushRows == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// writeJSONBuffered encodes v as JSON through a write buffer of the given
+// size, 0 writing directly
+func writeJSONBuffered(w io.Writer, v interface{}, size int) error {
+	if size <= 0 {
+		return json.NewEncoder(w).Encode(v)
+	}
+	out := bufio.NewWriterSize(w, size)
+	if err := json.NewEncoder(out).Encode(v); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// userFilter selects users in list queries
+type userFilter struct {
+	role     string
+	query    string
+	verified *bool
+}
+
+// parseUserFilter reads the role, q and verified query parameters
+func parseUserFilter(r *http.Request) (userFilter, error) {
+	params := r.URL.Query()
+	filter := userFilter{
+		role:  params.Get("role"),
+		query: strings.ToLower(params.Get("q")),
+	}
+
+	if value := params.Get("verified"); value != "" {
+		verified, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, errors.New("Invalid verified filter")
+		}
+		filter.verified = &verified
+	}
+
+	return filter, nil
+}
+
+// matches reports whether u has the filter's exact role and verification
+// status, and contains the search text in its username, name or email,
+// ignoring case. Empty criteria match everything.
+func (f userFilter) matches(u User) bool {
+	if f.role != "" && u.Role != f.role {
+		return false
+	}
+	if f.verified != nil && u.EmailVerified != *f.verified {
+		return false
+	}
+	if f.query != "" &&
+		!strings.Contains(strings.ToLower(u.Username), f.query) &&
+		!strings.Contains(strings.ToLower(u.Name), f.query) &&
+		!strings.Contains(strings.ToLower(u.Email), f.query) {
+		return false
+	}
+	return true
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// userPage is one page of the user list
+type userPage struct {
+	Users  []User `json:"users"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// parsePagination reads the limit and offset query parameters, applying the
+// default limit and capping it at maxPageLimit
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return 0, 0, errors.New("limit must be a non-negative integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// Get user by ID
+func (us *UserService) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/{id}").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}", status).Inc()
+	}()
+
+	id := mux.Vars(r)["id"]
+
+	_, span := tracer.Start(r.Context(), "getUser", trace.WithAttributes(attribute.String("user.id", id)))
+	defer span.End()
+
+	us.mutex.RLock()
+	user, exists := us.users[id]
+	us.mutex.RUnlock()
+
+	if !exists {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	w.Header().Set("ETag", etagFor(user))
+	writeNegotiated(w, r, http.StatusOK, user)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"user_id": id,
+	}).Info("Retrieved user")
+}
+
+// Look up a single user by exact email or username through the Redis indexes
+func (us *UserService) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/search").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/search", status).Inc()
+	}()
+
+	email := r.URL.Query().Get("email")
+	username := r.URL.Query().Get("username")
+	if (email == "") == (username == "") {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Exactly one of email or username is required"})
+		return
+	}
+
+	key := us.usernameIndexKey(username)
+	if email != "" {
+		key = emailIndexKey(email)
+	}
+
+	id, err := us.lookupIndex(r.Context(), key)
+	if err != nil && err != redis.Nil {
+		us.requestLogger(r).WithError(err).Error("Failed to read user index from Redis")
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User store unavailable"})
+		return
+	}
+
+	us.mutex.RLock()
+	user, exists := us.users[id]
+	us.mutex.RUnlock()
+
+	// Treat an entry pointing at a missing user, or at one whose field has
+	// since changed, as no match rather than returning the wrong user
+	if err == redis.Nil || !exists ||
+		(email != "" && !strings.EqualFold(user.Email, email)) ||
+		(username != "" && !us.sameUsername(user.Username, username)) {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	writeNegotiated(w, r, http.StatusOK, user)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"user_id": user.ID,
+	}).Info("Found user")
+}
+
+// Create user
+func (us *UserService) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "201"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users", status).Inc()
+	}()
+
+	ctx, span := tracer.Start(r.Context(), "createUser")
+	defer span.End()
+
+	var user User
+	if err := decodeSingleJSON(r.Body, &user); err != nil {
+		status = writeDecodeError(w, err)
+		return
+	}
+
+	if err := validateUser(user, us.requiredFields); err != nil {
+		status = "400"
+		writeValidationError(w, err)
+		return
+	}
+
+	// The cache catches most duplicates cheaply. The index claims in saveUser
+	// are what stop two concurrent creates with the same username or email
+	// from both succeeding.
+	us.mutex.RLock()
+	field := us.conflictingField(user, "")
+	us.mutex.RUnlock()
+	if field != "" {
+		status = "409"
+		writeConflict(w, field)
+		return
+	}
+
+	// Random IDs need no coordination between replicas and don't reveal how
+	// many users exist
+	user.ID = newUUID()
+	span.SetAttributes(attribute.String("user.id", user.ID))
+	user.EmailVerified = false
+	now := us.clock.Now()
+	user.Created = now.Format(time.RFC3339)
+	user.Updated = user.Created
+	if err := us.saveUser(ctx, user, User{}); err != nil {
+		span.RecordError(err)
+		status = us.writeStoreError(w, r, err)
+		return
+	}
+	us.mutex.Lock()
+	us.users[user.ID] = user
+	us.mutex.Unlock()
+
+	w.Header().Set("Location", userPath(user.ID))
+	w.Header().Set("ETag", etagFor(user))
+	writeNegotiated(w, r, http.StatusCreated, user)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":       r.Method,
+		"path":         r.URL.Path,
+		"user_id":      user.ID,
+		"username":     user.Username,
+		"display_name": user.displayName(),
+	}).Info("Created user")
+}
+
+// maxBatchSize is the default cap on the number of users accepted by one
+// batch create, overridden by MAX_BULK_SIZE
+const maxBatchSize = 1000
+
+var (
+	errBatchNotArray = errors.New("batch must be a JSON array")
+	errBatchTooLarge = errors.New("batch too large")
+)
+
+// decodeBatch decodes a JSON array of users one element at a time, so a
+// batch over max items is rejected as soon as the extra item starts rather
+// than after the whole array has been read into memory
+func decodeBatch(body io.Reader, max int) ([]User, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errBatchNotArray
+	}
+
+	var users []User
+	for decoder.More() {
+		if len(users) == max {
+			return nil, errBatchTooLarge
+		}
+		var user User
+		if err := decoder.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	// Closing bracket
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errMultipleDocuments
+	}
+	return users, nil
+}
+
+// batchResult reports the outcome of one item of a batch create
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	User   *User  `json:"user,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+// Create several users at once. Items are validated independently and the
+// response lists the outcome per item. By default the batch is atomic: if
+// any item fails, none are stored. With ?partial=true the valid items are
+// stored anyway and the answer is 207 Multi-Status.
+func (us *UserService) batchCreateHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/batch").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/batch", status).Inc()
+	}()
+
+	ctx, span := tracer.Start(r.Context(), "batchCreateUsers")
+	defer span.End()
+
+	partial := r.URL.Query().Get("partial") == "true"
+
+	users, err := decodeBatch(r.Body, us.maxBulkSize)
+	if err == errBatchTooLarge {
+		status = "413"
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Batch must contain at most %d users", us.maxBulkSize),
+		})
+		return
+	}
+	if err != nil {
+		status = writeDecodeError(w, err)
+		return
+	}
+
+	if len(users) == 0 {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Batch must contain at least one user"})
+		return
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(users)))
+
+	results := make([]batchResult, len(users))
+	created := make([]User, 0, len(users))
+
+	// As with single creates, the cache check is backed by the index claims
+	// in insertUsers. Values claimed earlier in the same batch count as taken
+	// too.
+	us.mutex.RLock()
+	now := us.clock.Now()
+	claimed := make(map[string]bool)
+	for i, user := range users {
+		results[i].Index = i
+
+		if err := validateUser(user, us.requiredFields); err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = err.Error()
+			var validationErr *validationError
+			if errors.As(err, &validationErr) {
+				results[i].Field = validationErr.Field
+			}
+			continue
+		}
+
+		field := us.conflictingField(user, "")
+		if field == "" && user.Username != "" && claimed[us.usernameIndexKey(user.Username)] {
+			field = "username"
+		}
+		if field == "" && user.Email != "" && claimed[emailIndexKey(user.Email)] {
+			field = "email"
+		}
+		if field != "" {
+			results[i].Status = http.StatusConflict
+			results[i].Error = "A user with this " + field + " already exists"
+			results[i].Field = field
+			continue
+		}
+		claimed[us.usernameIndexKey(user.Username)] = true
+		claimed[emailIndexKey(user.Email)] = true
+
+		user.ID = newUUID()
+		user.EmailVerified = false
+		user.Created = now.Format(time.RFC3339)
+		user.Updated = user.Created
+		created = append(created, user)
+		results[i].Status = http.StatusCreated
+	}
+	us.mutex.RUnlock()
+
+	if len(created) < len(users) && !partial {
+		// Nothing is stored; the valid items are reported as failed because
+		// of the others, and the batch as a whole takes the status of the
+		// worst failure
+		code := http.StatusConflict
+		for i := range results {
+			switch results[i].Status {
+			case http.StatusBadRequest:
+				code = http.StatusBadRequest
+			case http.StatusCreated:
+				results[i].Status = http.StatusFailedDependency
+				results[i].Error = "Not created because other items in the batch failed"
+			}
+		}
+		status = strconv.Itoa(code)
+		writeNegotiated(w, r, code, results)
+
+		us.requestLogger(r).WithFields(logrus.Fields{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"items":  len(users),
+			"failed": len(users) - len(created),
+		}).Info("Rejected batch")
+		return
+	}
+
+	if len(created) > 0 {
+		if err := us.insertUsers(ctx, created); err != nil {
+			span.RecordError(err)
+			status = us.writeStoreError(w, r, err)
+			return
+		}
+		us.mutex.Lock()
+		for _, user := range created {
+			us.users[user.ID] = user
+		}
+		us.mutex.Unlock()
+	}
+
+	next := 0
+	for i := range results {
+		if results[i].Status == http.StatusCreated {
+			results[i].User = &created[next]
+			next++
+		}
+	}
+
+	code := http.StatusOK
+	if partial {
+		code = http.StatusMultiStatus
+	}
+	status = strconv.Itoa(code)
+	writeNegotiated(w, r, code, results)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"items":   len(users),
+		"created": len(created),
+	}).Info("Batch created users")
+}
+
+// writeNegotiated writes status and encodes v as MessagePack when the client
+// prefers application/msgpack, as HAL when it prefers application/hal+json,
+// and as plain JSON otherwise
+func writeNegotiated(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	return encodeNegotiated(w, w, r, status, v)
+}
+
+// writeNegotiatedBuffered is like writeNegotiated but stages the body in a
+// buffer of the given size, so large payloads go out in fewer writes
+func writeNegotiatedBuffered(w http.ResponseWriter, r *http.Request, status int, v interface{}, size int) error {
+	if size <= 0 {
+		return writeNegotiated(w, r, status, v)
+	}
+
+	buffered := bufio.NewWriterSize(w, size)
+	err := encodeNegotiated(w, buffered, r, status, v)
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// encodeNegotiated sets the negotiated content type and status on w and
+// encodes v to out
+func encodeNegotiated(w http.ResponseWriter, out io.Writer, r *http.Request, status int, v interface{}) error {
+	accept := r.Header.Get("Accept")
+	v = presentUsers(v)
+
+	// The body depends on Accept, so caches must key on it
+	w.Header().Add("Vary", "Accept")
+
+	switch negotiateMediaType(accept, "application/json", "application/msgpack", "application/hal+json") {
+	case "application/msgpack":
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.WriteHeader(status)
+		enc := msgpack.NewEncoder(out)
+		enc.SetCustomStructTag("json")
+		return enc.Encode(v)
+	case "application/hal+json":
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(status)
+		return json.NewEncoder(out).Encode(withLinks(v))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(out).Encode(v)
+}
+
+// negotiateMediaType returns the offer the Accept header rates highest, or
+// "" when it accepts none of them. Ties go to the offer matched by the more
+// specific range, then to the earlier offer; an empty header accepts the
+// first.
+func negotiateMediaType(header string, offers ...string) string {
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+
+	best, bestQuality, bestLevel := "", 0.0, -1
+	for _, offer := range offers {
+		quality, level := mediaTypeQuality(header, offer)
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && level > bestLevel) {
+			best, bestQuality, bestLevel = offer, quality, level
+		}
+	}
+	return best
+}
+
+// mediaTypeQuality returns the q-value the Accept header gives mediaType,
+// taken from the most specific range matching it, and how specific that
+// range was: 2 for the type itself, 1 for type/*, 0 for */* and -1 when
+// nothing matched
+func mediaTypeQuality(header, mediaType string) (float64, int) {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, level := 0.0, -1
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		var rangeLevel int
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mediaType:
+			rangeLevel = 2
+		case mainType + "/*":
+			rangeLevel = 1
+		case "*/*":
+			rangeLevel = 0
+		default:
+			continue
+		}
+		if rangeLevel <= level {
+			continue
+		}
+
+		rangeQuality := 1.0
+		for _, param := range params[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+					rangeQuality = parsed
+				}
+			}
+		}
+		quality, level = rangeQuality, rangeLevel
+	}
+	return quality, level
+}
+
+// halLink is a HAL hypermedia link
+type halLink struct {
+	Href string `json:"href"`
+}
+
+// halUser is a User with its HAL _links section
+type halUser struct {
+	User
+	Links map[string]halLink `json:"_links"`
+}
+
+// userIDPattern matches user IDs in routes: lowercase UUIDs, or the decimal
+// IDs of users created before IDs became UUIDs. New users only ever get
+// UUIDs; the decimal alternative is a transition path for records already in
+// Redis and can be dropped once no user:{<number>} keys remain.
+const userIDPattern = `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|[0-9]+`
+
+// userPath is the canonical URL path of a user
+func userPath(id string) string {
+	return "/users/" + id
+}
+
+// withLinks adds HAL self links to users, leaving other values unchanged
+func withLinks(v interface{}) interface{} {
+	switch value := v.(type) {
+	case User:
+		return halUser{User: value, Links: map[string]halLink{"self": {Href: userPath(value.ID)}}}
+	case []User:
+		users := make([]halUser, len(value))
+		for i, user := range value {
+			users[i] = withLinks(user).(halUser)
+		}
+		return users
+	case userPage:
+		return map[string]interface{}{
+			"users":  withLinks(value.Users),
+			"total":  value.Total,
+			"limit":  value.Limit,
+			"offset": value.Offset,
+		}
+	default:
+		return v
+	}
+}
+
+// presentUsers fills in the presented form of any users in v, leaving other
+// values unchanged
+func presentUsers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case User:
+		return value.presented()
+	case []User:
+		users := make([]User, len(value))
+		for i, user := range value {
+			users[i] = user.presented()
+		}
+		return users
+	case userPage:
+		value.Users = presentUsers(value.Users).([]User)
+		return value
+	case []batchResult:
+		results := make([]batchResult, len(value))
+		for i, result := range value {
+			if result.User != nil {
+				user := result.User.presented()
+				result.User = &user
+			}
+			results[i] = result
+		}
+		return results
+	default:
+		return v
+	}
+}
+
+// userSnapshot is the serialized form of a point-in-time copy of all users
+type userSnapshot struct {
+	Created string `json:"created"`
+	Users   []User `json:"users"`
+}
+
+// snapshotKeyPrefix namespaces snapshot keys in Redis
+const snapshotKeyPrefix = "snapshot:users:"
+
+// Snapshot all users to Redis (admin only)
+func (us *UserService) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "201"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/admin/snapshot").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/admin/snapshot", status).Inc()
+	}()
+
+	now := us.clock.Now()
+	snapshot := userSnapshot{Created: now.Format(time.RFC3339)}
+
+	us.mutex.RLock()
+	for _, user := range us.users {
+		snapshot.Users = append(snapshot.Users, user)
+	}
+	us.mutex.RUnlock()
+
+	sort.Slice(snapshot.Users, func(i, j int) bool {
+		return lessUser(snapshot.Users[i], snapshot.Users[j])
+	})
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		status = "500"
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode snapshot"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	key := snapshotKeyPrefix + now.Format("20060102T150405Z")
+	if err := us.redis.Set(ctx, key, data, 0).Err(); err != nil {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to write snapshot to Redis"})
+		us.requestLogger(r).WithError(err).Error("Snapshot failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     key,
+		"created": snapshot.Created,
+		"count":   len(snapshot.Users),
+	})
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"key":   key,
+		"count": len(snapshot.Users),
+	}).Info("Created user snapshot")
+}
+
+// Restore all users from a Redis snapshot (admin only)
+func (us *UserService) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/admin/restore").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/admin/restore", status).Inc()
+	}()
+
+	key := r.URL.Query().Get("key")
+	if !strings.HasPrefix(key, snapshotKeyPrefix) {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid snapshot key"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	data, err := us.redis.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Snapshot not found"})
+		return
+	}
+	if err != nil {
+		status = "503"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read snapshot from Redis"})
+		us.requestLogger(r).WithError(err).Error("Restore failed")
+		return
+	}
+
+	var snapshot userSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		status = "500"
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Corrupt snapshot"})
+		return
+	}
+
+	// A snapshot replaces every user at once, so it must meet the same rules
+	// as creating them one by one
+	if err := us.checkSnapshot(snapshot.Users); err != nil {
+		status = "422"
+		body := map[string]string{"error": "Invalid snapshot: " + err.Error()}
+		var validationErr *validationError
+		if errors.As(err, &validationErr) {
+			body["field"] = validationErr.Field
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+
+	users := make(map[string]User, len(snapshot.Users))
+	for _, user := range snapshot.Users {
+		users[user.ID] = user
+	}
+
+	us.mutex.Lock()
+	if err := us.replaceUsers(r.Context(), users); err != nil {
+		us.mutex.Unlock()
+		status = us.writeStoreError(w, r, err)
+		return
+	}
+	us.users = users
+	us.lastRemoval = us.clock.Now()
+	us.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     key,
+		"created": snapshot.Created,
+		"count":   len(users),
+	})
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"key":   key,
+		"count": len(users),
+	}).Info("Restored user snapshot")
+}
+
+// checkSnapshot applies the create-time checks to the users of a snapshot:
+// each needs an ID and must pass validateUser, and no two may share an ID,
+// username or email
+func (us *UserService) checkSnapshot(users []User) error {
+	ids := make(map[string]bool, len(users))
+	claimed := make(map[string]bool, 2*len(users))
+	for _, user := range users {
+		if user.ID == "" {
+			return errors.New("user without an ID")
+		}
+		if ids[user.ID] {
+			return fmt.Errorf("user %s appears twice", user.ID)
+		}
+		ids[user.ID] = true
+
+		if err := validateUser(user, us.requiredFields); err != nil {
+			return fmt.Errorf("user %s: %w", user.ID, err)
+		}
+		for _, field := range []struct{ name, value, key string }{
+			{"username", user.Username, us.usernameIndexKey(user.Username)},
+			{"email", user.Email, emailIndexKey(user.Email)},
+		} {
+			if field.value == "" {
+				continue
+			}
+			if claimed[field.key] {
+				return fmt.Errorf("user %s: %w", user.ID, &validationError{Field: field.name, Message: field.name + " is shared with another user"})
+			}
+			claimed[field.key] = true
+		}
+	}
+	return nil
+}
+
+// Get or set maintenance mode (admin only)
+func (us *UserService) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/admin/maintenance").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/admin/maintenance", status).Inc()
+	}()
+
+	if r.Method == http.MethodPut {
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := decodeSingleJSON(r.Body, &body); err != nil {
+			status = writeDecodeError(w, err)
+			return
+		}
+		if body.Enabled == nil {
+			status = "400"
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Body must be {\"enabled\": true|false}"})
+			return
+		}
+
+		us.maintenance.Store(*body.Enabled)
+		us.requestLogger(r).WithField("enabled", *body.Enabled).Info("Maintenance mode changed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": us.maintenance.Load()})
+}
+
+// sensitiveHeaders are redacted from echoed requests
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+// Echo request details for debugging proxies (admin only)
+func (us *UserService) echoHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/admin/echo").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/admin/echo", "200").Inc()
+	}()
+
+	headers := make(map[string][]string, len(r.Header))
+	for name, values := range r.Header {
+		if sensitiveHeaders[name] {
+			headers[name] = []string{"[REDACTED]"}
+			continue
+		}
+		headers[name] = values
+	}
+
+	response := map[string]interface{}{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"headers":     headers,
+		"query":       r.URL.Query(),
+		"remote_addr": r.RemoteAddr,
+		"client_ip":   us.clientIP(r),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// clientIP resolves the originating client address. Forwarding headers are
+// only believed when the connection comes from a trusted proxy, since any
+// client can send them; X-Forwarded-For is then read from the right,
+// skipping hops that are trusted proxies themselves.
+func (us *UserService) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !us.trustedProxy(host) {
+		return host
+	}
+
+	if hops := splitList(r.Header.Get("X-Forwarded-For")); len(hops) > 0 {
+		for i := len(hops) - 1; i > 0; i-- {
+			if !us.trustedProxy(hops[i]) {
+				return hops[i]
+			}
+		}
+		return hops[0]
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return host
+}
+
+// trustedProxy reports whether addr falls within TRUSTED_PROXIES
+func (us *UserService) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range us.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs and bare IPs,
+// returning the networks and the entries that could not be parsed
+func parseTrustedProxies(value string) ([]*net.IPNet, []string) {
+	var networks []*net.IPNet
+	var invalid []string
+	for _, item := range splitList(value) {
+		// A bare address stands for a single-host network
+		if ip := net.ParseIP(item); ip != nil {
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		invalid = append(invalid, item)
+	}
+	return networks, invalid
+}
+
+// routeEndpoint is the endpoint label for metrics recorded outside a handler:
+// the matched route's path template without variable patterns (so
+// "/users/{id}"), or the raw path when none matched
+func routeEndpoint(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return stripRoutePatterns(template)
+		}
+	}
+	return r.URL.Path
+}
+
+// stripRoutePatterns drops the regexp from each {name:pattern} variable of a
+// route template. Patterns may themselves contain braces.
+func stripRoutePatterns(template string) string {
+	var b strings.Builder
+	depth := 0
+	inPattern := false
+	for _, c := range template {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				inPattern = false
+			}
+		case c == ':' && depth == 1:
+			inPattern = true
+		}
+		if !inPattern {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// emailVerificationToken derives the token that proves ownership of the
+// user's current email. It is an HMAC of the ID and email, so the mailer can
+// compute it with the shared secret and it stops working if the email changes.
+func (us *UserService) emailVerificationToken(u User) string {
+	mac := hmac.New(sha256.New, us.verifySecret)
+	fmt.Fprintf(mac, "%s:%s", u.ID, strings.ToLower(u.Email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Update user
+func (us *UserService) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/{id}").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}", status).Inc()
+	}()
+
+	id := mux.Vars(r)["id"]
+
+	// With an update_mask only the listed fields are taken from the body
+	mask, err := parseUpdateMask(r.URL.Query().Get("update_mask"))
+	if err != nil {
+		status = "400"
+		writeValidationError(w, err)
+		return
+	}
+
+	var update User
+	if err := decodeSingleJSON(r.Body, &update); err != nil {
+		status = writeDecodeError(w, err)
+		return
+	}
+
+	// A masked update is validated once merged with the stored user
+	if mask == nil {
+		if err := validateUser(update, us.requiredFields); err != nil {
+			status = "400"
+			writeValidationError(w, err)
+			return
+		}
+	}
+
+	unlock := us.lockUser(id)
+	defer unlock()
+
+	us.mutex.RLock()
+	existing, exists := us.users[id]
+	if exists && mask != nil {
+		update = applyUpdateMask(existing, update, mask)
+	}
+	field := us.conflictingField(update, id)
+	us.mutex.RUnlock()
+	if !exists {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if mask != nil {
+		if err := validateUser(update, us.requiredFields); err != nil {
+			status = "400"
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if code := checkPreconditions(r, existing); code != 0 {
+		status = strconv.Itoa(code)
+		writePreconditionError(w, code)
+		return
+	}
+
+	if field != "" {
+		status = "409"
+		writeConflict(w, field)
+		return
+	}
+
+	// ID and Created are immutable; verification only carries over while the
+	// email stays the same
+	user := User{
+		ID:            id,
+		Username:      update.Username,
+		Email:         update.Email,
+		Name:          update.Name,
+		DisplayName:   update.DisplayName,
+		Role:          update.Role,
+		EmailVerified: existing.EmailVerified && strings.EqualFold(existing.Email, update.Email),
+		Created:       existing.Created,
+	}
+	now := us.clock.Now()
+	user.Updated = now.Format(time.RFC3339)
+	if err := us.saveUser(r.Context(), user, existing); err != nil {
+		status = us.writeStoreError(w, r, err)
+		return
+	}
+	us.mutex.Lock()
+	us.users[id] = user
+	us.mutex.Unlock()
+
+	w.Header().Set("ETag", etagFor(user))
+	writeNegotiated(w, r, http.StatusOK, user)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":       r.Method,
+		"path":         r.URL.Path,
+		"user_id":      id,
+		"username":     user.Username,
+		"display_name": user.displayName(),
+	}).Info("Updated user")
+}
+
+// readOnlyUserFields are user fields a patch may not touch
+var readOnlyUserFields = map[string]bool{
+	"id":             true,
+	"created":        true,
+	"updated":        true,
+	"email_verified": true,
+}
+
+// writableFields maps the JSON names of the fields clients may set to the
+// fields of u
+func writableFields(u *User) map[string]*string {
+	return map[string]*string{
+		"username":     &u.Username,
+		"email":        &u.Email,
+		"name":         &u.Name,
+		"display_name": &u.DisplayName,
+		"role":         &u.Role,
+	}
+}
+
+// parseUpdateMask parses a comma-separated update_mask into a set of field
+// names. An empty mask means the whole user is replaced and gives nil.
+func parseUpdateMask(value string) (map[string]bool, error) {
+	paths := splitList(value)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	writable := writableFields(&User{})
+	mask := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if _, ok := writable[path]; !ok {
+			return nil, &validationError{Field: "update_mask", Message: "update_mask path " + strconv.Quote(path) + " is not an updatable field"}
+		}
+		mask[path] = true
+	}
+	return mask, nil
+}
+
+// applyUpdateMask returns existing with only the fields in mask taken from
+// update, as in a gRPC FieldMask
+func applyUpdateMask(existing, update User, mask map[string]bool) User {
+	masked := existing
+	targets := writableFields(&masked)
+	sources := writableFields(&update)
+	for field := range mask {
+		*targets[field] = *sources[field]
+	}
+	return masked
+}
+
+// applyPatch sets the fields present in patch on u. Explicit nulls and
+// read-only fields are rejected; unknown fields are ignored, as in a PUT.
+func applyPatch(u *User, patch map[string]json.RawMessage) error {
+	targets := writableFields(u)
+
+	// Sorted so the reported field doesn't depend on map order
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		if readOnlyUserFields[field] {
+			return &validationError{Field: field, Message: field + " cannot be changed"}
+		}
+		target, ok := targets[field]
+		if !ok {
+			continue
+		}
+		raw := patch[field]
+		if string(raw) == "null" {
+			return &validationError{Field: field, Message: field + " cannot be null"}
+		}
+		if err := json.Unmarshal(raw, target); err != nil {
+			return &validationError{Field: field, Message: field + " must be a string"}
+		}
+	}
+	return nil
+}
+
+// Partially update user
+func (us *UserService) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/{id}").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}", status).Inc()
+	}()
+
+	id := mux.Vars(r)["id"]
+
+	var patch map[string]json.RawMessage
+	if err := decodeSingleJSON(r.Body, &patch); err != nil {
+		status = writeDecodeError(w, err)
+		return
+	}
+
+	unlock := us.lockUser(id)
+	defer unlock()
+
+	us.mutex.RLock()
+	existing, exists := us.users[id]
+	us.mutex.RUnlock()
+	if !exists {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if code := checkPreconditions(r, existing); code != 0 {
+		status = strconv.Itoa(code)
+		writePreconditionError(w, code)
+		return
+	}
 
+	user := existing
+	if err := applyPatch(&user, patch); err != nil {
+		status = "400"
+		writeValidationError(w, err)
+		return
+	}
+	if err := validateUser(user, us.requiredFields); err != nil {
+		status = "400"
+		writeValidationError(w, err)
+		return
+	}
+
+	us.mutex.RLock()
+	field := us.conflictingField(user, id)
+	us.mutex.RUnlock()
+	if field != "" {
+		status = "409"
+		writeConflict(w, field)
+		return
+	}
+
+	// Verification only carries over while the email stays the same
+	user.EmailVerified = existing.EmailVerified && strings.EqualFold(existing.Email, user.Email)
+	now := us.clock.Now()
+	user.Updated = now.Format(time.RFC3339)
+	if err := us.saveUser(r.Context(), user, existing); err != nil {
+		status = us.writeStoreError(w, r, err)
+		return
+	}
+	us.mutex.Lock()
+	us.users[id] = user
+	us.mutex.Unlock()
+
+	w.Header().Set("ETag", etagFor(user))
+	writeNegotiated(w, r, http.StatusOK, user)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"user_id": id,
+		"fields":  len(patch),
+	}).Info("Patched user")
+}
+
+// Delete user
+func (us *UserService) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "204"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/{id}").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}", status).Inc()
+	}()
+
+	id := mux.Vars(r)["id"]
+
+	unlock := us.lockUser(id)
+	defer unlock()
+
+	us.mutex.RLock()
+	existing, exists := us.users[id]
+	us.mutex.RUnlock()
+	if !exists {
+		status = "404"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if err := us.removeUser(r.Context(), existing); err != nil {
+		status = us.writeStoreError(w, r, err)
+		return
+	}
+	us.mutex.Lock()
+	delete(us.users, id)
+	us.lastRemoval = us.clock.Now()
+	us.mutex.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+
+	us.requestLogger(r).WithFields(logrus.Fields{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"user_id": id,
+	}).Info("Deleted user")
+}
+
+// Verify a user's email address
+func (us *UserService) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := "200"
+	defer func() {
+		duration := time.Since(start).Seconds()
+		us.requestDuration.WithLabelValues(r.Method, "/users/{id}/verify-email").Observe(duration)
+		us.requestsTotal.WithLabelValues(r.Method, "/users/{id}/verify-email", status).Inc()
+	}()
+
+	id := mux.Vars(r)["id"]
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := decodeSingleJSON(r.Body, &body); err != nil {
+		status = writeDecodeError(w, err)
+		return
+	}
+
+	unlock := us.lockUser(id)
+	defer unlock()
+
+	us.mutex.RLock()
+	user, exists := us.users[id]
+	us.mutex.RUnlock()
 	if !exists {
 		status = "404"
 		w.WriteHeader(http.StatusNotFound)
@@ -211,89 +2382,414 @@ func (us *UserService) getUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !hmac.Equal([]byte(body.Token), []byte(us.emailVerificationToken(user))) {
+		status = "400"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid verification token"})
+		return
+	}
+
+	if !user.EmailVerified {
+		previous := user
+		now := us.clock.Now()
+		user.EmailVerified = true
+		user.Updated = now.Format(time.RFC3339)
+		if err := us.saveUser(r.Context(), user, previous); err != nil {
+			status = us.writeStoreError(w, r, err)
+			return
+		}
+		us.mutex.Lock()
+		us.users[id] = user
+		us.mutex.Unlock()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(user.presented())
 
-	us.logger.WithFields(logrus.Fields{
+	us.requestLogger(r).WithFields(logrus.Fields{
 		"method":  r.Method,
 		"path":    r.URL.Path,
 		"user_id": id,
-	}).Info("Retrieved user")
+	}).Info("Verified user email")
 }
 
-// Create user
-func (us *UserService) createUserHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	status := "201"
-	defer func() {
-		duration := time.Since(start).Seconds()
-		us.requestDuration.WithLabelValues(r.Method, "/users").Observe(duration)
-		us.requestsTotal.WithLabelValues(r.Method, "/users", status).Inc()
-	}()
+// sameUsername reports whether two usernames name the same account, which
+// ignores case with USERNAME_CASE_INSENSITIVE
+func (us *UserService) sameUsername(a, b string) bool {
+	if us.foldUsernames {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		status = "400"
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
-		return
+// conflictingField returns "username" or "email" when a user other than
+// exceptID already holds that value, or "" when u is unique. Emails compare
+// case-insensitively, usernames only with USERNAME_CASE_INSENSITIVE. The
+// caller must hold us.mutex.
+func (us *UserService) conflictingField(u User, exceptID string) string {
+	for id, existing := range us.users {
+		if id == exceptID {
+			continue
+		}
+		if u.Username != "" && us.sameUsername(existing.Username, u.Username) {
+			return "username"
+		}
+		if u.Email != "" && strings.EqualFold(existing.Email, u.Email) {
+			return "email"
+		}
 	}
+	return ""
+}
 
-	us.mutex.Lock()
-	// Generate new ID
-	maxID := 0
-	for id := range us.users {
-		if id > maxID {
-			maxID = id
+// writeStoreError responds to a write that could not be persisted to Redis:
+// 409 when another replica claimed one of the user's unique fields first,
+// 503 otherwise. It returns the status label for metrics.
+func (us *UserService) writeStoreError(w http.ResponseWriter, r *http.Request, err error) string {
+	var conflict *indexConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, conflict.field)
+		return "409"
+	}
+
+	us.requestLogger(r).WithError(err).Error("Failed to persist user data to Redis")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"error": "User store unavailable"})
+	return "503"
+}
+
+// etagFor is a strong entity tag for the current state of a user
+func etagFor(u User) string {
+	data, _ := json.Marshal(u)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkPreconditions enforces optimistic concurrency on writes to an
+// existing user. If-Match is checked when present; otherwise
+// If-Unmodified-Since is compared against the user's Updated time. It
+// returns 428 when the request has neither, 412 when the precondition
+// fails, and 0 otherwise.
+func checkPreconditions(r *http.Request, current User) int {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+		if err != nil {
+			return http.StatusPreconditionRequired
 		}
+		updated, err := time.Parse(time.RFC3339, current.Updated)
+		if err != nil || updated.After(since) {
+			return http.StatusPreconditionFailed
+		}
+		return 0
 	}
-	user.ID = maxID + 1
-	user.Created = time.Now().Format(time.RFC3339)
-	us.users[user.ID] = user
-	us.mutex.Unlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	etag := etagFor(current)
+	for _, tag := range splitList(header) {
+		if tag == "*" || tag == etag {
+			return 0
+		}
+	}
+	return http.StatusPreconditionFailed
+}
 
-	us.logger.WithFields(logrus.Fields{
-		"method":   r.Method,
-		"path":     r.URL.Path,
-		"user_id":  user.ID,
-		"username": user.Username,
-	}).Info("Created user")
+// writePreconditionError responds with the status from checkPreconditions
+func writePreconditionError(w http.ResponseWriter, code int) {
+	message := "If-Match or If-Unmodified-Since header is required"
+	if code == http.StatusPreconditionFailed {
+		message = "User was modified since it was read"
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// writeConflict responds 409 naming the field that collided
+func writeConflict(w http.ResponseWriter, field string) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "A user with this " + field + " already exists",
+		"field": field,
+	})
+}
+
+// Middleware turning a handler panic into a 500 instead of a dropped
+// connection. It is registered first so it also covers the other middleware.
+func (us *UserService) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate abort, let net/http close the connection quietly
+				panic(recovered)
+			}
+
+			panicMessage := fmt.Sprint(recovered)
+			stack := string(debug.Stack())
+
+			us.panicsTotal.Inc()
+			us.requestsTotal.WithLabelValues(r.Method, routeEndpoint(r), "500").Inc()
+			// The request ID middleware runs inside this one, so the ID is
+			// only visible on the response headers it set
+			us.logger.WithFields(logrus.Fields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"request_id": w.Header().Get(requestIDHeader),
+				"panic":      panicMessage,
+				"stack":      stack,
+			}).Error("Recovered from panic")
+
+			body := map[string]string{"error": "internal server error"}
+			if us.config.debugErrors {
+				body["panic"] = panicMessage
+				body["stack"] = stack
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(body)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Middleware for logging and metrics
 func (us *UserService) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		
-		us.logger.WithFields(logrus.Fields{
-			"method": r.Method,
-			"path":   r.URL.Path,
-			"ip":     r.RemoteAddr,
-		}).Info("Request started")
+		// Deferred so the count drops even if a handler panics
+		us.inFlight.Add(1)
+		us.requestsInFlight.Inc()
+		defer func() {
+			us.inFlight.Add(-1)
+			us.requestsInFlight.Dec()
+		}()
 
-		next.ServeHTTP(w, r)
+		// Probe and scrape paths still count towards metrics but are not
+		// access logged
+		quiet := us.quietPaths[r.URL.Path]
+
+		if !us.combinedLogs && !quiet {
+			us.requestLogger(r).WithFields(logrus.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"ip":     r.RemoteAddr,
+			}).Info("Request started")
+		}
+
+		// Authentication happens further in, so it reports the caller back
+		// through this holder
+		var user string
+		r = r.WithContext(context.WithValue(r.Context(), userHolderContextKey, &user))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if quiet {
+			return
+		}
+
+		if us.combinedLogs {
+			fields := logrus.Fields{
+				"method":    r.Method,
+				"path":      r.URL.Path,
+				"status":    recorder.status,
+				"duration":  time.Since(start).String(),
+				"bytes":     recorder.bytes,
+				"client_ip": us.clientIP(r),
+			}
+			if user != "" {
+				fields["user"] = user
+			}
+			us.requestLogger(r).WithFields(fields).Info("Request handled")
+			return
+		}
 
-		us.logger.WithFields(logrus.Fields{
+		us.requestLogger(r).WithFields(logrus.Fields{
 			"method":   r.Method,
 			"path":     r.URL.Path,
+			"status":   recorder.status,
 			"duration": time.Since(start).String(),
 		}).Info("Request completed")
 	})
 }
 
-// CORS middleware
-func corsMiddleware(next http.Handler) http.Handler {
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// countResponseClasses counts every response by status class. It wraps the
+// whole router rather than being registered with router.Use, since mux skips
+// middleware for unmatched paths (404) and methods (405).
+func (us *UserService) countResponseClasses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		us.responsesByClass.WithLabelValues(statusClass(recorder.status)).Inc()
+	})
+}
+
+// statusClass maps a status code to its class label, e.g. 404 -> "4xx"
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// Middleware capping request body size. http.MaxBytesReader enforces the
+// limit on the bytes actually read, so it also holds for chunked bodies
+// without a Content-Length; rejecting a declared oversized Content-Length up
+// front only saves reading the body.
+func (us *UserService) bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > us.maxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Request body too large"})
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, us.maxBodyBytes)
+		if us.minUploadRate > 0 {
+			r.Body = newMinRateReader(r.Body, us.minUploadRate, time.Now())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errMultipleDocuments = errors.New("request body holds more than one JSON document")
+
+// decodeSingleJSON decodes one JSON document from body into v, failing with
+// errMultipleDocuments when anything but whitespace follows it, so a second
+// concatenated object isn't silently ignored
+func decodeSingleJSON(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errMultipleDocuments
+	}
+	return nil
+}
+
+// writeDecodeError responds to a request body that decodeSingleJSON
+// rejected and returns the status label for metrics
+func writeDecodeError(w http.ResponseWriter, err error) string {
+	if isBodyTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Request body too large"})
+		return "413"
+	}
+	if errors.Is(err, errUploadTooSlow) {
+		w.WriteHeader(http.StatusRequestTimeout)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Request body upload too slow"})
+		return "408"
+	}
+	if err == errMultipleDocuments {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Request body must contain a single JSON document",
+			"code":  "MULTIPLE_JSON_DOCUMENTS",
+		})
+		return "400"
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+	return "400"
+}
+
+// isBodyTooLarge reports whether err came from exceeding the body size limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// uploadRateGrace is how long a body upload may run before its rate is checked,
+// so a slow start or a small body is not mistaken for a slow-POST
+const uploadRateGrace = 5 * time.Second
+
+var errUploadTooSlow = errors.New("request body upload too slow")
+
+// minRateReader fails a request body read once the average upload rate drops
+// below a minimum. A client that stops sending entirely is still bounded by
+// the server's ReadTimeout; this catches clients trickling bytes just fast
+// enough to keep the connection alive.
+type minRateReader struct {
+	io.ReadCloser
+	rate  float64
+	start time.Time
+	read  int64
+}
+
+func newMinRateReader(body io.ReadCloser, rate float64, start time.Time) *minRateReader {
+	return &minRateReader{ReadCloser: body, rate: rate, start: start}
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	if err == nil {
+		if elapsed := time.Since(r.start); elapsed > uploadRateGrace && float64(r.read)/elapsed.Seconds() < r.rate {
+			// The bytes just read are dropped; the upload is abandoned anyway
+			return 0, errUploadTooSlow
+		}
+	}
+	return n, err
+}
+
+// maintenanceRetryAfter is the Retry-After hint, in seconds, sent while in
+// maintenance mode
+const maintenanceRetryAfter = "300"
+
+// Middleware answering user API requests with 503 while maintenance mode is
+// on. Health, readiness, metrics and admin routes are left alone.
+func (us *UserService) maintenanceMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if us.maintenance.Load() && (r.URL.Path == "/users" || strings.HasPrefix(r.URL.Path, "/users/")) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", maintenanceRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "The user service is down for maintenance, please retry later",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+// Middleware answering user and admin API requests with 503 until the users
+// have been loaded from Redis, so nothing is read from or checked against an
+// empty cache
+func (us *UserService) loadingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if !us.loaded.Load() && (path == "/users" || strings.HasPrefix(path, "/users/") || strings.HasPrefix(path, "/admin/")) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "The user service is starting up, please retry later",
+			})
 			return
 		}
 
@@ -301,6 +2797,109 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// deprecationMiddleware flags responses from deprecated endpoints with
+// Deprecation, and when configured Sunset and Link, headers so clients get
+// advance notice. Endpoints are matched by their route path template.
+func deprecationMiddleware(endpoints map[string]bool, sunset time.Time, link string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if endpoints[routeEndpoint(r)] {
+				w.Header().Set("Deprecation", "true")
+				if !sunset.IsZero() {
+					w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+				}
+				if link != "" {
+					w.Header().Set("Link", "<"+link+`>; rel="deprecation"; type="text/html"`)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsAllowedMethods and corsAllowedHeaders are what cross-origin requests
+// may use
+var (
+	corsAllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsAllowedHeaders = []string{"Content-Type", "Authorization", "If-Match", "If-Unmodified-Since"}
+)
+
+// preflightAllowed reports whether the method and headers a preflight asks
+// for are all in the allowed sets. Header names compare case-insensitively.
+func preflightAllowed(r *http.Request) bool {
+	method := r.Header.Get("Access-Control-Request-Method")
+	methodAllowed := false
+	for _, allowed := range corsAllowedMethods {
+		methodAllowed = methodAllowed || method == allowed
+	}
+	if !methodAllowed {
+		return false
+	}
+
+	for _, header := range splitList(strings.Join(r.Header.Values("Access-Control-Request-Headers"), ",")) {
+		headerAllowed := false
+		for _, allowed := range corsAllowedHeaders {
+			headerAllowed = headerAllowed || strings.EqualFold(header, allowed)
+		}
+		if !headerAllowed {
+			return false
+		}
+	}
+	return true
+}
+
+// CORS middleware. With no allowed origins configured any origin is allowed
+// through the "*" wildcard, without credentials. Otherwise only origins in
+// the allowlist are echoed back, with credentials permitted, and other
+// origins get no CORS headers at all so the browser blocks them. Preflights
+// asking for a method or header outside the allowed sets get a 403.
+func corsMiddleware(allowedOrigins map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				// The preflight answer depends on what was asked for
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			allowed := true
+			if len(allowedOrigins) == 0 {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// The response differs per origin, so caches must key on it
+				w.Header().Add("Vary", "Origin")
+				origin := r.Header.Get("Origin")
+				allowed = allowedOrigins[strings.ToLower(origin)]
+				if allowed {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if allowed && preflight && !preflightAllowed(r) {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "CORS request method or headers not allowed"})
+				return
+			}
+
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+				w.Header().Set("Access-Control-Expose-Headers", "ETag")
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 var startTime time.Time
 
 func init() {
@@ -314,54 +2913,414 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func main() {
-	userService := NewUserService()
+// getEnvPath reads a route path from the environment, rejecting paths that
+// are not absolute
+func getEnvPath(key, defaultValue string) (string, error) {
+	path := getEnv(key, defaultValue)
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("%s must be an absolute path, got %q", key, path)
+	}
+	return path, nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
+// parseBuckets parses a comma-separated list of strictly increasing
+// histogram bucket bounds
+func parseBuckets(value string) ([]float64, error) {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+	buckets := make([]float64, 0, len(items))
+	for _, item := range items {
+		bucket, err := strconv.ParseFloat(item, 64)
+		if err != nil || math.IsNaN(bucket) || math.IsInf(bucket, 0) {
+			return nil, fmt.Errorf("invalid bucket %q", item)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %v is not greater than %v", bucket, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// handlerConfig is the routing and middleware configuration Handler builds
+// the router from. NewUserService reads and validates it once.
+type handlerConfig struct {
+	healthPath      string
+	readyPath       string
+	metricsPath     string
+	gzipEnabled     bool
+	gzipMinSize     int
+	allowedOrigins  map[string]bool
+	rateLimit       float64
+	rateBurst       int
+	maxBulk         int
+	deprecated      map[string]bool
+	sunset          time.Time
+	deprecationLink string
+	metricsToken    string
+	readOnly        bool
+	adminEndpoints  bool
+	debugErrors     bool
+}
+
+// loadHandlerConfig reads the handler configuration from the environment
+func loadHandlerConfig() (handlerConfig, error) {
+	var cfg handlerConfig
+	var err error
+
+	// Health endpoints, mounted where the platform's probes and scrapers expect them
+	if cfg.healthPath, err = getEnvPath("HEALTH_PATH", "/health"); err != nil {
+		return cfg, err
+	}
+	if cfg.readyPath, err = getEnvPath("READY_PATH", "/ready"); err != nil {
+		return cfg, err
+	}
+	if cfg.metricsPath, err = getEnvPath("METRICS_PATH", "/metrics"); err != nil {
+		return cfg, err
+	}
+
+	cfg.gzipEnabled = getEnv("GZIP_ENABLED", "true") == "true"
+	if cfg.gzipMinSize, err = strconv.Atoi(getEnv("GZIP_MIN_SIZE", "1024")); err != nil || cfg.gzipMinSize < 0 {
+		return cfg, fmt.Errorf("invalid GZIP_MIN_SIZE: %q", getEnv("GZIP_MIN_SIZE", ""))
+	}
+
+	// Origins allowed to make cross-origin requests, e.g.
+	// "https://shop.example.com"; empty keeps the permissive wildcard
+	cfg.allowedOrigins = make(map[string]bool)
+	for _, origin := range splitList(getEnv("CORS_ALLOWED_ORIGINS", "")) {
+		cfg.allowedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	// Per-client request rate limit, RATE_LIMIT_RPS=0 disables it
+	if cfg.rateLimit, err = strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "10"), 64); err != nil || cfg.rateLimit < 0 {
+		return cfg, fmt.Errorf("invalid RATE_LIMIT_RPS: %q", getEnv("RATE_LIMIT_RPS", ""))
+	}
+	if cfg.rateBurst, err = strconv.Atoi(getEnv("RATE_LIMIT_BURST", "20")); err != nil || cfg.rateBurst < 1 {
+		return cfg, fmt.Errorf("invalid RATE_LIMIT_BURST: %q", getEnv("RATE_LIMIT_BURST", ""))
+	}
+
+	// Bulk endpoints hold every user they touch in memory at once, so only a
+	// few may run at a time; 0 lifts the limit
+	if cfg.maxBulk, err = strconv.Atoi(getEnv("MAX_CONCURRENT_BULK", "2")); err != nil || cfg.maxBulk < 0 {
+		return cfg, fmt.Errorf("invalid MAX_CONCURRENT_BULK: %q", getEnv("MAX_CONCURRENT_BULK", ""))
+	}
+
+	// Endpoints being phased out, as route templates (e.g. "/users"), with an
+	// optional removal date (RFC 3339) and a link to migration docs
+	cfg.deprecated = make(map[string]bool)
+	for _, endpoint := range splitList(getEnv("DEPRECATED_ENDPOINTS", "")) {
+		cfg.deprecated[endpoint] = true
+	}
+	if value := getEnv("DEPRECATION_SUNSET", ""); value != "" {
+		if cfg.sunset, err = time.Parse(time.RFC3339, value); err != nil {
+			return cfg, fmt.Errorf("invalid DEPRECATION_SUNSET: %q", value)
+		}
+	}
+	cfg.deprecationLink = getEnv("DEPRECATION_LINK", "")
+
+	cfg.metricsToken = getEnv("METRICS_AUTH_TOKEN", "")
+	cfg.readOnly = getEnv("READ_ONLY", "false") == "true"
+	cfg.adminEndpoints = getEnv("ADMIN_ENDPOINTS", "false") == "true"
+	// Development only: expose panic details in 500 responses
+	cfg.debugErrors = getEnv("DEBUG_ERRORS", "false") == "true"
+	return cfg, nil
+}
+
+// Handler builds the service's router with its full middleware stack from
+// the configuration NewUserService read. It has no side effects, so it may
+// be called more than once; the handlers share the service's state. It is
+// what main serves, and lets another application mount the service inside
+// its own server.
+func (us *UserService) Handler() http.Handler {
 	router := mux.NewRouter()
+	cfg := us.config
 
 	// Apply middleware
-	router.Use(userService.loggingMiddleware)
-	router.Use(corsMiddleware)
+	router.Use(us.recoverMiddleware)
+	router.Use(requestIDMiddleware)
+	router.Use(us.loggingMiddleware)
+
+	// Compress responses for clients that accept gzip. The metrics endpoint is
+	// left alone since promhttp negotiates its own compression.
+	if cfg.gzipEnabled {
+		router.Use(gzipMiddleware(cfg.gzipMinSize, map[string]bool{cfg.metricsPath: true}))
+	}
+
+	// CORS comes before rate limiting and auth so their 429s and 401s carry
+	// the CORS headers too; without them browsers report a CORS failure
+	// instead of the real status.
+	router.Use(corsMiddleware(cfg.allowedOrigins))
+
+	if us.rateLimiter != nil {
+		router.Use(us.rateLimiter.middleware(us.logger, us.clientIP))
+	}
+
+	if len(us.jwtSecret) > 0 {
+		router.Use(us.authMiddleware)
+	}
+
+	router.Use(us.bodyLimitMiddleware)
+
+	if len(cfg.deprecated) > 0 {
+		router.Use(deprecationMiddleware(cfg.deprecated, cfg.sunset, cfg.deprecationLink))
+	}
+	router.Use(us.maintenanceMiddleware)
+	router.Use(us.loadingMiddleware)
 
 	// Health endpoints
-	router.HandleFunc("/health", userService.healthHandler).Methods("GET")
-	router.HandleFunc("/ready", userService.readyHandler).Methods("GET")
-	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc(cfg.healthPath, us.healthHandler).Methods("GET")
+	router.HandleFunc(cfg.readyPath, us.readyHandler).Methods("GET")
+	// The metrics token protects the metrics route alone; the JWT check
+	// treats it as public since scrapers don't carry user tokens
+	metricsHandler := us.metricsHandler()
+	if cfg.metricsToken != "" {
+		metricsHandler = us.requireMetricsToken(cfg.metricsToken, metricsHandler)
+	}
+	router.Handle(cfg.metricsPath, metricsHandler)
+	router.HandleFunc("/openapi.json", us.openAPIHandler).Methods("GET")
+
+	// Everything that changes or bulk-reads user data needs the admin role
+	adminOnly := us.requireRole("admin")
+
+	// Admin endpoints are only exposed when explicitly enabled
+	if cfg.adminEndpoints {
+		router.Handle("/admin/echo", adminOnly(http.HandlerFunc(us.echoHandler))).Methods("GET")
+		router.Handle("/admin/snapshot", adminOnly(us.limitBulk(http.HandlerFunc(us.snapshotHandler)))).Methods("POST")
+		router.Handle("/admin/maintenance", adminOnly(http.HandlerFunc(us.maintenanceHandler))).Methods("GET", "PUT")
+		if !cfg.readOnly {
+			router.Handle("/admin/restore", adminOnly(us.limitBulk(http.HandlerFunc(us.restoreHandler)))).Methods("POST")
+		}
+	}
+
+	// API endpoints. IDs are UUIDs; the decimal IDs of users created before the
+	// switch are still accepted.
+	router.HandleFunc("/users", us.getUsersHandler).Methods("GET")
+	router.HandleFunc("/users/search", us.searchUsersHandler).Methods("GET")
+	router.Handle("/users/export", adminOnly(us.limitBulk(http.HandlerFunc(us.exportUsersHandler)))).Methods("GET")
+	router.HandleFunc("/users/{id:"+userIDPattern+"}", us.getUserHandler).Methods("GET")
+
+	// In read-only mode the write routes are never registered, so the router
+	// answers them with 405 Method Not Allowed
+	if cfg.readOnly {
+		// These paths have no read route for the method check to fall back
+		// on, so they need an explicit 405 rather than a 404
+		methodNotAllowed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})
+		router.Handle("/users/batch", methodNotAllowed)
+		if len(us.verifySecret) > 0 {
+			router.Handle("/users/{id:"+userIDPattern+"}/verify-email", methodNotAllowed)
+		}
+	} else {
+		// Only admins may create, modify or delete accounts; reads stay open to
+		// any authenticated caller. Users can't edit their own record, since
+		// the same body would also let them change their role.
+		router.Handle("/users", adminOnly(http.HandlerFunc(us.createUserHandler))).Methods("POST")
+		router.Handle("/users/batch", adminOnly(us.limitBulk(http.HandlerFunc(us.batchCreateHandler)))).Methods("POST")
+		router.Handle("/users/{id:"+userIDPattern+"}", adminOnly(http.HandlerFunc(us.updateUserHandler))).Methods("PUT")
+		router.Handle("/users/{id:"+userIDPattern+"}", adminOnly(http.HandlerFunc(us.patchUserHandler))).Methods("PATCH")
+		router.Handle("/users/{id:"+userIDPattern+"}", adminOnly(http.HandlerFunc(us.deleteUserHandler))).Methods("DELETE")
+
+		// Verification tokens are derived from a shared secret, so the
+		// endpoint is only available once one is configured. It stays open
+		// to any role: the token in the link is what proves ownership of the
+		// address, and the user clicking it is usually not an admin.
+		if len(us.verifySecret) > 0 {
+			router.HandleFunc("/users/{id:"+userIDPattern+"}/verify-email", us.verifyEmailHandler).Methods("POST")
+		}
+	}
+
+	// Preflight requests need a route of their own: mux answers a method it
+	// has no route for with 405 without running any middleware, so the CORS
+	// middleware would never see them. It answers them before this handler.
+	// The method is checked with a plain matcher rather than Methods, which
+	// would make every unknown path a 405 instead of a 404.
+	router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return r.Method == http.MethodOptions
+	}).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return otelhttp.NewHandler(us.countResponseClasses(router), "user-service")
+}
+
+// watchSignals returns a channel closed by the first signal on c, which
+// starts the shutdown. A repeated signal while it is in progress (e.g. an
+// impatient orchestrator) calls exit instead, forcing an immediate exit.
+func watchSignals(c <-chan os.Signal, logger *logrus.Logger, exit func(int)) <-chan struct{} {
+	var shutdownOnce sync.Once
+	started := make(chan struct{})
+	go func() {
+		for sig := range c {
+			first := false
+			shutdownOnce.Do(func() {
+				first = true
+				close(started)
+			})
+			if !first {
+				logger.WithField("signal", sig.String()).Warn("Received signal during shutdown, forcing exit")
+				exit(1)
+			}
+		}
+	}()
+	return started
+}
+
+func main() {
+	userService, err := NewUserService(prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Tracing setup failed: %v", err)
+	}
 
-	// API endpoints
-	router.HandleFunc("/users", userService.getUsersHandler).Methods("GET")
-	router.HandleFunc("/users/{id:[0-9]+}", userService.getUserHandler).Methods("GET")
-	router.HandleFunc("/users", userService.createUserHandler).Methods("POST")
+	// Health endpoints, also served by the optional probe server
+	healthPath := userService.config.healthPath
+	readyPath := userService.config.readyPath
 
 	port := getEnv("PORT", "8080")
 	srv := &http.Server{
 		Addr:         ":" + port,
-		Handler:      router,
+		Handler:      userService.Handler(),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Server startup failed: %v", err)
+	}
+
+	// How long in-flight requests get to finish once shutdown starts
+	shutdownTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil || shutdownTimeout <= 0 {
+		log.Fatalf("Invalid SHUTDOWN_TIMEOUT: %q", getEnv("SHUTDOWN_TIMEOUT", ""))
+	}
+	userService.logger.WithField("shutdown_timeout", shutdownTimeout.String()).Info("Graceful shutdown timeout configured")
+
+	// How long to keep serving after /ready starts failing, giving the
+	// orchestrator time to stop routing traffic here
+	drainDelay, err := time.ParseDuration(getEnv("SHUTDOWN_DRAIN_DELAY", "0s"))
+	if err != nil || drainDelay < 0 {
+		log.Fatalf("Invalid SHUTDOWN_DRAIN_DELAY: %q", getEnv("SHUTDOWN_DRAIN_DELAY", ""))
+	}
+
+	// Optionally throttle how fast new connections are accepted
+	acceptRate, err := strconv.ParseFloat(getEnv("ACCEPT_RATE_LIMIT", "0"), 64)
+	if err != nil || acceptRate < 0 {
+		log.Fatalf("Invalid ACCEPT_RATE_LIMIT: %q", getEnv("ACCEPT_RATE_LIMIT", "0"))
+	}
+	if acceptRate > 0 {
+		acceptBurst, err := strconv.Atoi(getEnv("ACCEPT_RATE_BURST", strconv.Itoa(int(math.Ceil(acceptRate)))))
+		if err != nil || acceptBurst < 1 {
+			log.Fatalf("Invalid ACCEPT_RATE_BURST: %q", getEnv("ACCEPT_RATE_BURST", ""))
+		}
+		listener = newRateLimitedListener(listener, acceptRate, acceptBurst, userService.connsRejected)
+		userService.logger.WithFields(logrus.Fields{
+			"rate":  acceptRate,
+			"burst": acceptBurst,
+		}).Info("Connection accept rate limit enabled")
+	}
+
+	// Optionally account bytes read and written per connection
+	if getEnv("CONN_BYTE_ACCOUNTING", "false") == "true" {
+		listener = newCountingListener(listener, userService.connBytes)
+		userService.logger.Info("Connection byte accounting enabled")
+	}
+
+	// Keep the liveness heartbeat fresh for as long as the process runs
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	defer stopHeartbeat()
+	go userService.runHeartbeat(heartbeatCtx)
+
 	// Start server in a goroutine
 	go func() {
 		userService.logger.WithField("port", port).Info("User service starting")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server startup failed: %v", err)
 		}
 	}()
 
+	// Optionally serve the probes from a dedicated server with its own listener,
+	// so liveness and readiness checks never queue behind user traffic
+	var probeSrv *http.Server
+	if probePort := getEnv("PROBE_PORT", ""); probePort != "" {
+		probeMux := http.NewServeMux()
+		probeMux.HandleFunc(healthPath, userService.healthHandler)
+		probeMux.HandleFunc(readyPath, userService.readyHandler)
+
+		probeSrv = &http.Server{
+			Addr:         ":" + probePort,
+			Handler:      probeMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		}
+
+		go func() {
+			userService.logger.WithField("port", probePort).Info("Probe server starting")
+			if err := probeSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Probe server startup failed: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown
-	c := make(chan os.Signal, 1)
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	<-watchSignals(c, userService.logger, os.Exit)
+
+	userService.draining.Store(true)
+	if drainDelay > 0 {
+		userService.logger.WithField("drain_delay", drainDelay.String()).Info("Draining, readiness now failing")
+		time.Sleep(drainDelay)
+	}
 
 	userService.logger.Info("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	// Running past the deadline is logged rather than fatal, so the pod still
+	// exits cleanly; the requests left behind are cut off either way
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			userService.logger.WithField("in_flight", userService.inFlight.Load()).Warn("Shutdown timeout reached with requests still in flight")
+		} else {
+			userService.logger.WithError(err).Error("Server shutdown failed")
+		}
+	}
+
+	if probeSrv != nil {
+		if err := probeSrv.Shutdown(ctx); err != nil {
+			userService.logger.WithError(err).Error("Probe server shutdown failed")
+		}
+	}
+
+	// User writes go to Redis synchronously, so once the servers have drained
+	// there is nothing left to flush and the service can be closed
+	if err := userService.Close(); err != nil {
+		userService.logger.WithError(err).Warn("Closing the user service failed")
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		userService.logger.WithError(err).Warn("Flushing traces failed")
 	}
 
 	userService.logger.Info("Server shutdown complete")
-}
\ No newline at end of file
+}
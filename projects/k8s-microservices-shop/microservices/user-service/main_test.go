@@ -0,0 +1,2310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// newTestService starts a service against an in-memory Redis with its own
+// metrics registry. env is applied before construction, so it reaches
+// everything NewUserService and Handler read.
+func newTestService(t *testing.T, env map[string]string) (*UserService, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	registry := prometheus.NewRegistry()
+	us, err := NewUserService(registry, registry)
+	if err != nil {
+		t.Fatalf("NewUserService: %v", err)
+	}
+	us.logger.SetOutput(io.Discard)
+	t.Cleanup(func() { us.Close() })
+	return us, mr
+}
+
+// doRequest sends a request through handler and returns the recorded response
+func doRequest(handler http.Handler, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// userIDByName looks up the ID of a seeded or created user
+func userIDByName(t *testing.T, us *UserService, username string) string {
+	t.Helper()
+	us.mutex.RLock()
+	defer us.mutex.RUnlock()
+	for id, user := range us.users {
+		if user.Username == username {
+			return id
+		}
+	}
+	t.Fatalf("no user named %q", username)
+	return ""
+}
+
+// decodeBody unmarshals a JSON response body into v
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(bytes.NewReader(rec.Body.Bytes())).Decode(v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestServiceRegistersIntoSuppliedRegistry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+
+	// The embedding application already owns collectors of its own
+	registry := prometheus.NewRegistry()
+	appRequests := prometheus.NewCounter(prometheus.CounterOpts{Name: "app_requests_total", Help: "Requests served by the app"})
+	registry.MustRegister(appRequests)
+	appRequests.Inc()
+
+	us, err := NewUserService(registry, registry)
+	if err != nil {
+		t.Fatalf("NewUserService: %v", err)
+	}
+	us.logger.SetOutput(io.Discard)
+	t.Cleanup(func() { us.Close() })
+
+	// A second service with its own registry must not collide with the first
+	other, _ := newTestService(t, nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/metrics", us.metricsHandler())
+	mux.HandleFunc("/app/users", us.getUsersHandler)
+	if rec := doRequest(mux, "GET", "/app/users", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("GET /app/users = %d, want 200", rec.Code)
+	}
+
+	rec := doRequest(mux, "GET", "/app/metrics", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /app/metrics = %d, want 200", rec.Code)
+	}
+	for _, name := range []string{"app_requests_total 1", "http_requests_total", "build_info"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("embedded metrics do not include %s", name)
+		}
+	}
+
+	rec = doRequest(other.metricsHandler(), "GET", "/metrics", "", nil)
+	if strings.Contains(rec.Body.String(), "app_requests_total") {
+		t.Error("the second service's registry exposes the embedding app's metrics")
+	}
+}
+
+func TestBuildInfoScrape(t *testing.T) {
+	// commit is normally set at link time and read at construction
+	oldCommit := commit
+	commit = "abc123"
+	defer func() { commit = oldCommit }()
+
+	us, _ := newTestService(t, map[string]string{"SERVICE_VERSION": "2.3.4", "RATE_LIMIT_RPS": "0"})
+	rec := doRequest(us.Handler(), "GET", "/metrics", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d, want 200", rec.Code)
+	}
+
+	want := fmt.Sprintf(`build_info{commit="abc123",goversion=%q,version="2.3.4"} 1`, runtime.Version())
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("scrape has no %s line:\n%s", want, rec.Body)
+	}
+}
+
+func TestSecondSignalForcesExit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	exits := make(chan int, 2)
+	signals := make(chan os.Signal, 2)
+
+	started := watchSignals(signals, logger, func(code int) { exits <- code })
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("first signal did not start the shutdown")
+	}
+	select {
+	case code := <-exits:
+		t.Fatalf("first signal exited with %d, want a graceful shutdown", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case code := <-exits:
+		if code != 1 {
+			t.Errorf("forced exit code = %d, want 1", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second signal did not force an exit")
+	}
+	close(signals)
+}
+
+func TestLogOutputToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	if err := os.WriteFile(path, []byte("earlier line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestService(t, map[string]string{"LOG_OUTPUT": "file:" + path})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "earlier line\n") {
+		t.Errorf("log file was truncated: %q", data)
+	}
+	if !strings.Contains(string(data), "Initialized user service") {
+		t.Errorf("startup logs missing from the log file: %q", data)
+	}
+}
+
+func TestLogOutputDestinations(t *testing.T) {
+	tests := []struct {
+		output string
+		want   io.Writer
+	}{
+		{"stdout", os.Stdout},
+		{"stderr", os.Stderr},
+		{"syslog", os.Stderr},
+		{"file:" + filepath.Join(t.TempDir(), "missing", "service.log"), os.Stderr},
+	}
+	for _, tt := range tests {
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		// Keep the fallback warnings out of the test output
+		logger.SetLevel(logrus.ErrorLevel)
+		configureLogOutput(logger, tt.output)
+		if logger.Out != tt.want {
+			t.Errorf("LOG_OUTPUT=%s writes to %v, want %v", tt.output, logger.Out, tt.want)
+		}
+	}
+}
+
+func TestMetricsPrefixAppliesToEveryMetric(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"METRICS_PREFIX": "userservice_", "RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	doRequest(handler, "GET", "/users", "", nil)
+
+	rec := doRequest(handler, "GET", "/metrics", "", nil)
+	for _, name := range []string{
+		"http_requests_total",
+		"http_request_duration_seconds",
+		"http_responses_by_class_total",
+		"connections_rejected_total",
+		"rate_limited_total",
+		"panics_total",
+		"http_requests_in_flight",
+		"build_info",
+	} {
+		if !strings.Contains(rec.Body.String(), "\n# TYPE userservice_"+name+" ") {
+			t.Errorf("scrape has no userservice_%s", name)
+		}
+	}
+
+	families, err := us.gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		// promhttp's own scrape counters are not ours to rename
+		if name := family.GetName(); !strings.HasPrefix(name, "userservice_") && !strings.HasPrefix(name, "promhttp_") {
+			t.Errorf("metric %s is missing the prefix", name)
+		}
+	}
+}
+
+func TestRedisDBSelection(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"3", 3},
+		{"-1", 0},
+		{"two", 0},
+	}
+	for _, tt := range tests {
+		us, mr := newTestService(t, map[string]string{"REDIS_DB": tt.value})
+		client, ok := us.redis.(*redis.Client)
+		if !ok {
+			t.Fatalf("REDIS_DB=%q built a %T, want *redis.Client", tt.value, us.redis)
+		}
+		if got := client.Options().DB; got != tt.want {
+			t.Errorf("REDIS_DB=%q used database %d, want %d", tt.value, got, tt.want)
+		}
+		if len(mr.DB(tt.want).Keys()) == 0 {
+			t.Errorf("REDIS_DB=%q: the seeded users are not in database %d", tt.value, tt.want)
+		}
+	}
+}
+
+func TestDrainingFailsReadinessOnly(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	ready := http.HandlerFunc(us.readyHandler)
+	health := http.HandlerFunc(us.healthHandler)
+
+	if rec := doRequest(ready, "GET", "/ready", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("GET /ready before shutdown = %d, want 200", rec.Code)
+	}
+
+	us.draining.Store(true)
+	rec := doRequest(ready, "GET", "/ready", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /ready while draining = %d, want 503", rec.Code)
+	}
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if body["error"] != "Shutting down" {
+		t.Errorf("draining readiness body = %v", body)
+	}
+
+	// Draining is not a liveness failure; restarting would cut requests short
+	if rec := doRequest(health, "GET", "/health", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /health while draining = %d, want 200", rec.Code)
+	}
+}
+
+func TestStaleHeartbeatFailsLiveness(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	health := http.HandlerFunc(us.healthHandler)
+
+	us.heartbeat.Store(us.clock.Now().Add(-2 * us.heartbeatTimeout).UnixNano())
+	if rec := doRequest(health, "GET", "/health", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /health with a stale heartbeat = %d, want 503", rec.Code)
+	}
+
+	us.heartbeat.Store(us.clock.Now().UnixNano())
+	if rec := doRequest(health, "GET", "/health", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /health with a fresh heartbeat = %d, want 200", rec.Code)
+	}
+}
+
+func TestBatchCreateReportsEachItem(t *testing.T) {
+	us, mr := newTestService(t, nil)
+	batch := http.HandlerFunc(us.batchCreateHandler)
+
+	rec := doRequest(batch, "POST", "/users/batch?partial=true", `[
+		{"username":"ok1","email":"ok1@example.com","role":"customer"},
+		{"username":"bad","email":"not-an-email","role":"customer"},
+		{"username":"taken","email":"john@example.com","role":"customer"},
+		{"username":"ok1","email":"other@example.com","role":"customer"},
+		{"username":"norole","email":"norole@example.com","role":"superuser"},
+		{"username":"ok2","email":"ok2@example.com","role":"admin"}
+	]`, nil)
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("POST /users/batch?partial=true = %d, want 207: %s", rec.Code, rec.Body.String())
+	}
+	var results []batchResult
+	decodeBody(t, rec, &results)
+
+	want := []struct {
+		status int
+		field  string
+	}{
+		{http.StatusCreated, ""},
+		{http.StatusBadRequest, "email"},
+		{http.StatusConflict, "email"},
+		{http.StatusConflict, "username"},
+		{http.StatusBadRequest, "role"},
+		{http.StatusCreated, ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Index != i || got.Status != w.status || got.Field != w.field {
+			t.Errorf("item %d = index %d status %d field %q, want status %d field %q", i, got.Index, got.Status, got.Field, w.status, w.field)
+		}
+		if (got.User != nil) != (w.status == http.StatusCreated) {
+			t.Errorf("item %d user = %+v", i, got.User)
+		}
+		if got.User != nil && (got.User.ID == "" || got.User.Created == "") {
+			t.Errorf("item %d was not assigned an ID and timestamps: %+v", i, got.User)
+		}
+	}
+
+	for _, result := range []batchResult{results[0], results[5]} {
+		if _, ok := us.users[result.User.ID]; !ok {
+			t.Errorf("created user %s is not cached", result.User.Username)
+		}
+		if !mr.Exists(userKey(result.User.ID)) {
+			t.Errorf("created user %s is not in Redis", result.User.Username)
+		}
+	}
+	if len(us.users) != 5 {
+		t.Errorf("%d users after the batch, want the 3 samples and 2 created", len(us.users))
+	}
+}
+
+// endlessBatch is a request body holding a JSON array that never ends. It
+// counts the bytes read from it.
+type endlessBatch struct {
+	started bool
+	read    int
+}
+
+func (b *endlessBatch) Read(p []byte) (int, error) {
+	item := `{"username":"u","email":"u@example.com","role":"customer"},`
+	if !b.started {
+		item = "[" + item
+		b.started = true
+	}
+	n := copy(p, item)
+	b.read += n
+	return n, nil
+}
+
+func TestBatchDecodingStopsAtTheSizeCap(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"MAX_BULK_SIZE": "50"})
+
+	body := &endlessBatch{}
+	rec := httptest.NewRecorder()
+	us.batchCreateHandler(rec, httptest.NewRequest("POST", "/users/batch", body))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("endless batch = %d, want 413", rec.Code)
+	}
+
+	// The decoder reads ahead in small chunks, so it stops a little past the
+	// 51st item, never near the whole stream
+	if limit := 200 * len(`{"username":"u","email":"u@example.com","role":"customer"},`); body.read > limit {
+		t.Errorf("read %d bytes of the batch, want at most %d", body.read, limit)
+	}
+
+	rec = doRequest(http.HandlerFunc(us.batchCreateHandler), "POST", "/users/batch", `{"username":"u"}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("batch that is not an array = %d, want 400", rec.Code)
+	}
+}
+
+func TestBatchCreateIsAtomicByDefault(t *testing.T) {
+	us, mr := newTestService(t, nil)
+	batch := http.HandlerFunc(us.batchCreateHandler)
+
+	rec := doRequest(batch, "POST", "/users/batch", `[
+		{"username":"ok1","email":"ok1@example.com","role":"customer"},
+		{"username":"taken","email":"john@example.com","role":"customer"}
+	]`, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("atomic batch with a conflict = %d, want 409: %s", rec.Code, rec.Body.String())
+	}
+	var results []batchResult
+	decodeBody(t, rec, &results)
+	if len(results) != 2 || results[0].Status != http.StatusFailedDependency || results[0].User != nil || results[1].Status != http.StatusConflict {
+		t.Errorf("atomic batch results = %+v, want 424 then 409", results)
+	}
+	if len(us.users) != 3 || mr.Exists(us.usernameIndexKey("ok1")) {
+		t.Errorf("a failed atomic batch stored users: %d cached", len(us.users))
+	}
+
+	// An invalid item outranks a conflict
+	rec = doRequest(batch, "POST", "/users/batch", `[
+		{"username":"taken","email":"john@example.com","role":"customer"},
+		{"username":"bad","email":"not-an-email","role":"customer"}
+	]`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("atomic batch with an invalid item = %d, want 400", rec.Code)
+	}
+
+	rec = doRequest(batch, "POST", "/users/batch", `[
+		{"username":"ok1","email":"ok1@example.com","role":"customer"},
+		{"username":"ok2","email":"ok2@example.com","role":"customer"}
+	]`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid atomic batch = %d, want 200", rec.Code)
+	}
+	decodeBody(t, rec, &results)
+	for _, result := range results {
+		if result.Status != http.StatusCreated || result.User == nil {
+			t.Errorf("valid atomic batch item = %+v, want 201 with the user", result)
+		}
+	}
+	if len(us.users) != 5 {
+		t.Errorf("%d users after a valid batch, want 5", len(us.users))
+	}
+}
+
+func TestBatchCreateRejectsOversizedBatches(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	items := make([]string, maxBatchSize+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"username":"u%d","email":"u%d@example.com","role":"customer"}`, i, i)
+	}
+
+	rec := doRequest(http.HandlerFunc(us.batchCreateHandler), "POST", "/users/batch", "["+strings.Join(items, ",")+"]", nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("batch of %d = %d, want 413", len(items), rec.Code)
+	}
+	if len(us.users) != 3 {
+		t.Errorf("%d users after a rejected batch, want 3", len(us.users))
+	}
+}
+
+func TestCSVExportParsesBack(t *testing.T) {
+	us, _ := newTestService(t, nil)
+
+	rec := doRequest(http.HandlerFunc(us.createUserHandler), "POST", "/users", `{"username":"quoted","email":"quoted@example.com","name":"Doe, \"Jay\"\nJr.","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+
+	rec = doRequest(http.HandlerFunc(us.exportUsersHandler), "GET", "/users/export?role=customer", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users/export = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != "attachment; filename=users.csv" {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parsing CSV export: %v", err)
+	}
+	if got := strings.Join(rows[0], ","); got != "id,username,email,name,role,created" {
+		t.Errorf("header row = %q", got)
+	}
+	names := map[string]string{}
+	for _, row := range rows[1:] {
+		if row[4] != "customer" {
+			t.Errorf("role filter let through %v", row)
+		}
+		names[row[1]] = row[3]
+	}
+	if len(names) != 3 {
+		t.Errorf("exported %d customers, want 3: %v", len(names), names)
+	}
+	if got := names["quoted"]; got != "Doe, \"Jay\"\nJr." {
+		t.Errorf("name with commas, quotes and a newline came back as %q", got)
+	}
+}
+
+// accessLoggedPaths returns the paths with an access log line in logs
+func accessLoggedPaths(t *testing.T, logs *bytes.Buffer) map[string]bool {
+	t.Helper()
+	paths := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("parsing log line %q: %v", line, err)
+		}
+		switch entry["msg"] {
+		case "Request started", "Request completed", "Request handled":
+			paths[entry["path"].(string)] = true
+		}
+	}
+	return paths
+}
+
+func TestProbeRequestsAreNotAccessLogged(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", us.healthHandler)
+	mux.HandleFunc("/users", us.getUsersHandler)
+	handler := us.loggingMiddleware(mux)
+
+	// What NewUserService sets up when LOG_PROBES is off
+	us.quietPaths = map[string]bool{"/health": true, "/ready": true, "/metrics": true}
+	for _, logStyle := range []bool{false, true} {
+		us.combinedLogs = logStyle
+		var logs bytes.Buffer
+		us.logger.SetOutput(&logs)
+
+		for _, path := range []string{"/health", "/users"} {
+			if rec := doRequest(handler, "GET", path, "", nil); rec.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d, want 200", path, rec.Code)
+			}
+		}
+
+		logged := accessLoggedPaths(t, &logs)
+		if !logged["/users"] {
+			t.Errorf("combined=%v: /users was not access logged", logStyle)
+		}
+		if logged["/health"] {
+			t.Errorf("combined=%v: /health was access logged", logStyle)
+		}
+	}
+
+	// Probes still count towards the request metrics
+	if got := testutil.ToFloat64(us.requestsTotal.WithLabelValues("GET", "/health", "200")); got != 2 {
+		t.Errorf("/health requests counted = %v, want 2", got)
+	}
+
+	// With LOG_PROBES=true nothing is quiet
+	us.quietPaths = nil
+	var logs bytes.Buffer
+	us.logger.SetOutput(&logs)
+	doRequest(handler, "GET", "/health", "", nil)
+	if !accessLoggedPaths(t, &logs)["/health"] {
+		t.Error("/health was not access logged with no quiet paths")
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := http.HandlerFunc(us.exportUsersHandler)
+
+	tests := []struct {
+		query, accept, contentType string
+	}{
+		{"?format=csv", "", "text/csv; charset=utf-8"},
+		{"?format=NDJSON", "", "application/x-ndjson"},
+		{"?format=json", "", "application/json"},
+		{"", "", "text/csv; charset=utf-8"},
+		{"", "application/x-ndjson", "application/x-ndjson"},
+		{"", "application/json", "application/json"},
+	}
+	for _, tt := range tests {
+		rec := doRequest(handler, "GET", "/users/export"+tt.query, "", map[string]string{"Accept": tt.accept})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("export %q (Accept %q) = %d, want 200", tt.query, tt.accept, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("export %q (Accept %q) Content-Type = %q, want %q", tt.query, tt.accept, got, tt.contentType)
+		}
+
+		var usernames []string
+		switch tt.contentType {
+		case "text/csv; charset=utf-8":
+			rows, err := csv.NewReader(rec.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("parsing CSV: %v", err)
+			}
+			for _, row := range rows[1:] {
+				usernames = append(usernames, row[1])
+			}
+		case "application/x-ndjson":
+			decoder := json.NewDecoder(rec.Body)
+			for decoder.More() {
+				var user User
+				if err := decoder.Decode(&user); err != nil {
+					t.Fatalf("parsing NDJSON: %v", err)
+				}
+				usernames = append(usernames, user.Username)
+			}
+		case "application/json":
+			var users []User
+			decodeBody(t, rec, &users)
+			for _, user := range users {
+				usernames = append(usernames, user.Username)
+			}
+		}
+		sort.Strings(usernames)
+		if got := strings.Join(usernames, ","); got != "admin,jane_smith,john_doe" {
+			t.Errorf("export %q (Accept %q) users = %s", tt.query, tt.accept, got)
+		}
+	}
+
+	rec := doRequest(handler, "GET", "/users/export?format=xml", "", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("export with format=xml = %d, want 400", rec.Code)
+	}
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if !strings.Contains(body["error"], "Invalid format") {
+		t.Errorf("invalid format error = %q", body["error"])
+	}
+}
+
+func TestCORSAllowlist(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	allowed := map[string]bool{"https://shop.example.com": true, "https://admin.example.com": true}
+	handler := corsMiddleware(allowed)(http.HandlerFunc(us.getUsersHandler))
+	corsHeaders := []string{
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Expose-Headers",
+	}
+
+	for _, method := range []string{"GET", "OPTIONS"} {
+		rec := doRequest(handler, method, "/users", "", map[string]string{"Origin": "https://evil.example.com"})
+		for _, header := range corsHeaders {
+			if got := rec.Header().Get(header); got != "" {
+				t.Errorf("%s from a disallowed origin got %s: %q", method, header, got)
+			}
+		}
+		if got := strings.Join(rec.Header().Values("Vary"), ", "); !strings.Contains(got, "Origin") {
+			t.Errorf("%s Vary = %q, want Origin listed", method, got)
+		}
+	}
+
+	rec := doRequest(handler, "GET", "/users", "", map[string]string{"Origin": "https://admin.example.com"})
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+		t.Errorf("allowed origin Access-Control-Allow-Origin = %q, want it echoed", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("allowed origin Access-Control-Allow-Credentials = %q, want true", got)
+	}
+}
+
+func TestCORSPreflightChecksRequestedMethodAndHeaders(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	allowed := map[string]bool{"https://shop.example.com": true}
+
+	for _, origins := range []map[string]bool{nil, allowed} {
+		handler := corsMiddleware(origins)(http.HandlerFunc(us.getUsersHandler))
+		preflight := func(method, headers string) *httptest.ResponseRecorder {
+			return doRequest(handler, "OPTIONS", "/users", "", map[string]string{
+				"Origin":                         "https://shop.example.com",
+				"Access-Control-Request-Method":  method,
+				"Access-Control-Request-Headers": headers,
+			})
+		}
+
+		rec := preflight("PATCH", "authorization, if-unmodified-since")
+		if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Methods") == "" {
+			t.Errorf("allowed preflight = %d %v, want 200 with CORS headers", rec.Code, rec.Header())
+		}
+		vary := strings.Join(rec.Header().Values("Vary"), ", ")
+		for _, header := range []string{"Access-Control-Request-Method", "Access-Control-Request-Headers"} {
+			if !strings.Contains(vary, header) {
+				t.Errorf("preflight Vary = %q, want %s listed", vary, header)
+			}
+		}
+
+		for _, tt := range []struct{ method, headers string }{
+			{"TRACE", ""},
+			{"GET", "X-Custom"},
+			{"PUT", "If-Match, X-Custom"},
+		} {
+			rec := preflight(tt.method, tt.headers)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("preflight for %s with %q = %d, want 403", tt.method, tt.headers, rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+				t.Errorf("rejected preflight Access-Control-Allow-Methods = %q, want none", got)
+			}
+		}
+	}
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"ADMIN_ENDPOINTS": "true", "RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	rec := doRequest(handler, "POST", "/admin/snapshot", "", nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /admin/snapshot = %d, want 201", rec.Code)
+	}
+	var snapshot struct {
+		Key string `json:"key"`
+	}
+	decodeBody(t, rec, &snapshot)
+
+	us.mutex.RLock()
+	before := make(map[string]User, len(us.users))
+	for id, user := range us.users {
+		before[id] = user
+	}
+	us.mutex.RUnlock()
+
+	// Change the live set every way a restore has to undo
+	anyVersion := map[string]string{"If-Match": "*"}
+	changes := []*httptest.ResponseRecorder{
+		doRequest(handler, "POST", "/users", `{"username":"later","email":"later@example.com","role":"customer"}`, nil),
+		doRequest(handler, "DELETE", "/users/"+userIDByName(t, us, "jane_smith"), "", anyVersion),
+		doRequest(handler, "PATCH", "/users/"+userIDByName(t, us, "john_doe"), `{"email":"changed@example.com"}`, anyVersion),
+	}
+	for i, rec := range changes {
+		if rec.Code >= 300 {
+			t.Fatalf("change %d = %d, want success: %s", i, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := doRequest(handler, "POST", "/admin/restore?key="+snapshot.Key, "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/restore = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	us.mutex.RLock()
+	after := us.users
+	us.mutex.RUnlock()
+	if len(after) != len(before) {
+		t.Fatalf("%d users after the restore, want %d", len(after), len(before))
+	}
+	for id, user := range before {
+		if after[id] != user {
+			t.Errorf("user %s = %+v after the restore, want %+v", id, after[id], user)
+		}
+	}
+
+	// The restored indexes are usable again: the old email is taken, the
+	// email from the undone change is free
+	if rec := doRequest(handler, "GET", "/users/search?email=john@example.com", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("search for the restored email = %d, want 200", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users/search?email=changed@example.com", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("search for the undone email = %d, want 404", rec.Code)
+	}
+}
+
+func TestRestoreRejectsInvalidSnapshots(t *testing.T) {
+	us, mr := newTestService(t, map[string]string{"ADMIN_ENDPOINTS": "true", "RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	tests := []struct {
+		name  string
+		users string
+		field string
+	}{
+		{"invalid email", `[{"id":"a","username":"a","email":"nope","role":"customer"}]`, "email"},
+		{"unknown role", `[{"id":"a","username":"a","email":"a@example.com","role":"root"}]`, "role"},
+		{"shared email", `[{"id":"a","username":"a","email":"x@example.com","role":"customer"},{"id":"b","username":"b","email":"X@example.com","role":"customer"}]`, "email"},
+		{"shared username", `[{"id":"a","username":"a","email":"a@example.com","role":"customer"},{"id":"b","username":"a","email":"b@example.com","role":"customer"}]`, "username"},
+		{"repeated ID", `[{"id":"a","username":"a","email":"a@example.com","role":"customer"},{"id":"a","username":"b","email":"b@example.com","role":"customer"}]`, ""},
+		{"missing ID", `[{"username":"a","email":"a@example.com","role":"customer"}]`, ""},
+	}
+	for _, tt := range tests {
+		key := snapshotKeyPrefix + "bad"
+		mr.Set(key, `{"created":"2024-01-01T00:00:00Z","users":`+tt.users+`}`)
+
+		rec := doRequest(handler, "POST", "/admin/restore?key="+key, "", nil)
+		var body map[string]string
+		decodeBody(t, rec, &body)
+		if rec.Code != http.StatusUnprocessableEntity || body["field"] != tt.field {
+			t.Errorf("%s: restore = %d %v, want 422 with field %q", tt.name, rec.Code, body, tt.field)
+		}
+		if len(us.users) != 3 {
+			t.Errorf("%s: %d users after a rejected restore, want the 3 samples", tt.name, len(us.users))
+		}
+	}
+}
+
+func TestEchoRedactsSensitiveHeaders(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"JWT_SECRET":      "test-secret",
+		"ADMIN_ENDPOINTS": "true",
+		"RATE_LIMIT_RPS":  "0",
+	})
+	handler := us.Handler()
+
+	headers := bearerFor(t, "test-secret", "admin", "admin")
+	token := headers["Authorization"]
+	headers["Cookie"] = "session=secret"
+	headers["X-Api-Key"] = "key-secret"
+	headers["X-Debug"] = "visible"
+
+	rec := doRequest(handler, "GET", "/admin/echo?trace=1", "", headers)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/echo = %d, want 200", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), token) || strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("echo leaked a credential: %s", rec.Body)
+	}
+
+	var echo struct {
+		Method   string              `json:"method"`
+		Headers  map[string][]string `json:"headers"`
+		Query    map[string][]string `json:"query"`
+		ClientIP string              `json:"client_ip"`
+	}
+	decodeBody(t, rec, &echo)
+	for _, name := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+		if got := echo.Headers[name]; len(got) != 1 || got[0] != "[REDACTED]" {
+			t.Errorf("echoed %s = %q, want [REDACTED]", name, got)
+		}
+	}
+	if got := echo.Headers["X-Debug"]; len(got) != 1 || got[0] != "visible" {
+		t.Errorf("echoed X-Debug = %q, want it unchanged", got)
+	}
+	if echo.Method != "GET" || echo.Query["trace"][0] != "1" || echo.ClientIP != "192.0.2.1" {
+		t.Errorf("echo = %+v", echo)
+	}
+
+	// Without ADMIN_ENDPOINTS the route does not exist
+	us, _ = newTestService(t, map[string]string{"JWT_SECRET": "", "ADMIN_ENDPOINTS": ""})
+	if rec := doRequest(us.Handler(), "GET", "/admin/echo", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/echo without ADMIN_ENDPOINTS = %d, want 404", rec.Code)
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := us.requireMetricsToken("scrape-token", metrics)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"wrong bearer", map[string]string{"Authorization": "Bearer nope"}, http.StatusUnauthorized},
+		{"wrong basic auth", map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("prometheus:nope"))}, http.StatusUnauthorized},
+		{"bearer", map[string]string{"Authorization": "Bearer scrape-token"}, http.StatusOK},
+		{"basic auth", map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("prometheus:scrape-token"))}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := doRequest(handler, "GET", "/metrics", "", tt.headers)
+		if rec.Code != tt.want {
+			t.Errorf("GET /metrics with %s = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("GET /metrics with %s has no WWW-Authenticate challenge", tt.name)
+		}
+	}
+}
+
+func TestServicesWithSeparateRegistries(t *testing.T) {
+	first, _ := newTestService(t, nil)
+	second, _ := newTestService(t, nil)
+
+	for _, us := range []*UserService{first, second} {
+		handler := us.Handler()
+		if rec := doRequest(handler, "GET", "/users", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("GET /users = %d, want 200", rec.Code)
+		}
+
+		rec := doRequest(handler, "GET", "/metrics", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /metrics = %d, want 200", rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `http_requests_total{endpoint="/users",method="GET",status="200"} 1`) {
+			t.Errorf("metrics missing this service's own request count:\n%s", rec.Body.String())
+		}
+	}
+}
+
+func TestInvalidHandlerConfigIsAnError(t *testing.T) {
+	tests := map[string]string{
+		"GZIP_MIN_SIZE":      "-1",
+		"RATE_LIMIT_RPS":     "fast",
+		"RATE_LIMIT_BURST":   "0",
+		"DEPRECATION_SUNSET": "next week",
+		"HEALTH_PATH":        "healthz",
+		"READY_PATH":         "ready",
+		"METRICS_PATH":       "metrics",
+	}
+	for key, value := range tests {
+		t.Run(key, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			t.Setenv("REDIS_URL", mr.Addr())
+			t.Setenv(key, value)
+
+			registry := prometheus.NewRegistry()
+			us, err := NewUserService(registry, registry)
+			if err == nil {
+				us.Close()
+				t.Fatalf("%s=%q was accepted", key, value)
+			}
+			if !strings.Contains(err.Error(), key) {
+				t.Errorf("error %q does not name %s", err, key)
+			}
+		})
+	}
+}
+
+func TestCustomProbeAndMetricsPaths(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"HEALTH_PATH":    "/healthz",
+		"READY_PATH":     "/readyz",
+		"METRICS_PATH":   "/internal/metrics",
+		"JWT_SECRET":     "test-secret",
+		"RATE_LIMIT_RPS": "0",
+	})
+	handler := us.Handler()
+
+	// The custom paths answer without a token, as the defaults would
+	for _, path := range []string{"/healthz", "/readyz", "/internal/metrics"} {
+		if rec := doRequest(handler, "GET", path, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, rec.Code)
+		}
+	}
+	if rec := doRequest(handler, "GET", "/internal/metrics", "", nil); !strings.Contains(rec.Body.String(), "build_info") {
+		t.Error("custom metrics path does not serve the metrics")
+	}
+
+	// The defaults are no longer routed
+	admin := bearerFor(t, "test-secret", "admin", "admin")
+	for _, path := range []string{"/health", "/ready", "/metrics"} {
+		if rec := doRequest(handler, "GET", path, "", admin); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestGetEnvPath(t *testing.T) {
+	if path, err := getEnvPath("TEST_PATH", "/default"); err != nil || path != "/default" {
+		t.Errorf("unset = %q, %v; want the default", path, err)
+	}
+	t.Setenv("TEST_PATH", "/custom/path")
+	if path, err := getEnvPath("TEST_PATH", "/default"); err != nil || path != "/custom/path" {
+		t.Errorf("absolute = %q, %v; want it returned", path, err)
+	}
+	t.Setenv("TEST_PATH", "relative")
+	if _, err := getEnvPath("TEST_PATH", "/default"); err == nil || !strings.Contains(err.Error(), "TEST_PATH") {
+		t.Errorf("relative path error = %v, want one naming TEST_PATH", err)
+	}
+}
+
+// trickleReader hands out its body one byte per read, like a client
+// dribbling an upload
+type trickleReader struct {
+	body []byte
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.body) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.body[0]
+	r.body = r.body[1:]
+	return 1, nil
+}
+
+func (r *trickleReader) Close() error { return nil }
+
+func TestMinRateReaderAbortsSlowUploads(t *testing.T) {
+	body := `{"username":"slow","email":"slow@example.com","role":"customer"}`
+	// Past the grace period, a few bytes are far below 1 KB/s
+	longAgo := time.Now().Add(-2 * uploadRateGrace)
+
+	slow := newMinRateReader(&trickleReader{body: []byte(body)}, 1024, longAgo)
+	if _, err := io.ReadAll(slow); !errors.Is(err, errUploadTooSlow) {
+		t.Errorf("trickled upload past the grace period = %v, want errUploadTooSlow", err)
+	}
+
+	// The same trickle is fine while still inside the grace period
+	early := newMinRateReader(&trickleReader{body: []byte(body)}, 1024, time.Now())
+	if data, err := io.ReadAll(early); err != nil || string(data) != body {
+		t.Errorf("trickled upload inside the grace period = %q, %v", data, err)
+	}
+
+	// A body arriving fast enough overall passes even after the grace period
+	fast := newMinRateReader(io.NopCloser(strings.NewReader(strings.Repeat("x", 64*1024))), 1024, longAgo)
+	if _, err := io.ReadFull(fast, make([]byte, 64*1024)); err != nil {
+		t.Errorf("fast upload = %v, want no error", err)
+	}
+
+	// Handlers turn the abort into a 408
+	us, _ := newTestService(t, nil)
+	req := httptest.NewRequest("POST", "/users", nil)
+	req.Body = newMinRateReader(&trickleReader{body: []byte(body)}, 1024, longAgo)
+	rec := httptest.NewRecorder()
+	us.createUserHandler(rec, req)
+	if rec.Code != http.StatusRequestTimeout {
+		t.Errorf("slow create = %d, want 408", rec.Code)
+	}
+	if len(us.users) != 3 {
+		t.Errorf("%d users after an aborted upload, want 3", len(us.users))
+	}
+}
+
+func TestChunkedBodyLimitedWithoutContentLength(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"MAX_BODY_BYTES": "1024", "RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	var seenLength atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenLength.Store(r.ContentLength)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// A plain io.Reader has no known length, so the client sends it chunked
+	post := func(body string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/users/batch", "application/json", io.MultiReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := seenLength.Load(); got != -1 {
+			t.Fatalf("request arrived with Content-Length %d, want it chunked", got)
+		}
+		return resp
+	}
+
+	item := `{"username":"u%d","email":"u%d@example.com","role":"customer"}`
+	var items []string
+	for i := 0; len(strings.Join(items, ",")) < 4096; i++ {
+		items = append(items, fmt.Sprintf(item, i, i))
+	}
+	if resp := post("[" + strings.Join(items, ",") + "]"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunked body = %d, want 413", resp.StatusCode)
+	}
+	if resp := post("[" + fmt.Sprintf(item, 0, 0) + "]"); resp.StatusCode != http.StatusOK {
+		t.Errorf("small chunked body = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestDeprecatedEndpointHeaders(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"DEPRECATED_ENDPOINTS": "/users/{id}",
+		"DEPRECATION_SUNSET":   "2030-01-01T00:00:00Z",
+		"DEPRECATION_LINK":     "https://docs.example.com/migrate",
+		"RATE_LIMIT_RPS":       "0",
+	})
+	handler := us.Handler()
+
+	// Matched by route template, so any user ID counts
+	rec := doRequest(handler, "GET", "/users/"+userIDByName(t, us, "john_doe"), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users/{id} = %d, want 200", rec.Code)
+	}
+	want := map[string]string{
+		"Deprecation": "true",
+		"Sunset":      "Tue, 01 Jan 2030 00:00:00 GMT",
+		"Link":        `<https://docs.example.com/migrate>; rel="deprecation"; type="text/html"`,
+	}
+	for header, value := range want {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+
+	rec = doRequest(handler, "GET", "/users", "", nil)
+	for header := range want {
+		if got := rec.Header().Get(header); got != "" {
+			t.Errorf("GET /users, not deprecated, has %s: %q", header, got)
+		}
+	}
+}
+
+func TestHandlerHasNoSideEffects(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "3"})
+	quiet, public := us.quietPaths, us.publicPaths
+
+	first := us.Handler()
+	// Changing the environment afterwards must not reach new handlers
+	t.Setenv("HEALTH_PATH", "relative")
+	t.Setenv("GZIP_MIN_SIZE", "-1")
+	second := us.Handler()
+
+	if fmt.Sprint(us.quietPaths) != fmt.Sprint(quiet) || fmt.Sprint(us.publicPaths) != fmt.Sprint(public) {
+		t.Error("Handler changed the service's quiet or public paths")
+	}
+	for _, handler := range []http.Handler{first, second} {
+		if rec := doRequest(handler, "GET", "/health", "", nil); rec.Code != http.StatusOK {
+			t.Errorf("GET /health = %d, want 200", rec.Code)
+		}
+	}
+
+	// Both handlers draw on the one rate limiter, whose burst is now spent
+	doRequest(first, "GET", "/users", "", nil)
+	if rec := doRequest(second, "GET", "/users", "", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second handler's request after the burst = %d, want 429", rec.Code)
+	}
+}
+
+func TestCORSPreflightReachesMiddleware(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"JWT_SECRET": "test-secret"})
+	handler := us.Handler()
+
+	for _, path := range []string{"/users", "/users/" + userIDByName(t, us, "john_doe")} {
+		rec := doRequest(handler, "OPTIONS", path, "", map[string]string{
+			"Origin":                         "https://shop.example.com",
+			"Access-Control-Request-Method":  "PUT",
+			"Access-Control-Request-Headers": "Authorization, If-Match",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("OPTIONS %s = %d, want 200", path, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("OPTIONS %s Access-Control-Allow-Origin = %q, want *", path, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "PUT") {
+			t.Errorf("OPTIONS %s Access-Control-Allow-Methods = %q, want PUT listed", path, got)
+		}
+	}
+	// The catch-all preflight route must not turn unknown paths into 405s
+	if rec := doRequest(handler, "GET", "/nowhere", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /nowhere = %d, want 404", rec.Code)
+	}
+}
+
+func TestCORSHeadersOnAuthAndRateLimitErrors(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"JWT_SECRET":           "test-secret",
+		"CORS_ALLOWED_ORIGINS": "https://shop.example.com",
+		"RATE_LIMIT_RPS":       "1",
+		"RATE_LIMIT_BURST":     "1",
+	})
+	handler := us.Handler()
+	origin := map[string]string{"Origin": "https://shop.example.com"}
+
+	for _, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		rec := doRequest(handler, "GET", "/users", "", origin)
+		if rec.Code != want {
+			t.Fatalf("GET /users = %d, want %d", rec.Code, want)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example.com" {
+			t.Errorf("%d response Access-Control-Allow-Origin = %q, want the request origin", want, got)
+		}
+	}
+}
+
+func TestResponseClassesCountUnmatchedRoutes(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"READ_ONLY": "true"})
+	handler := us.Handler()
+
+	if rec := doRequest(handler, "GET", "/nowhere", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET /nowhere = %d, want 404", rec.Code)
+	}
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	if rec := doRequest(handler, "DELETE", john, "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE %s in read-only mode = %d, want 405", john, rec.Code)
+	}
+
+	if got := testutil.ToFloat64(us.responsesByClass.WithLabelValues("4xx")); got != 2 {
+		t.Errorf("4xx responses counted = %v, want 2", got)
+	}
+}
+
+func TestReadOnlyModeAnswersWritesWith405(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"READ_ONLY":                 "true",
+		"EMAIL_VERIFICATION_SECRET": "verify-secret",
+	})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	routes := []struct {
+		method, path string
+	}{
+		{"POST", "/users"},
+		{"POST", "/users/batch"},
+		{"PUT", john},
+		{"PATCH", john},
+		{"DELETE", john},
+		{"POST", john + "/verify-email"},
+	}
+	for _, route := range routes {
+		if rec := doRequest(handler, route.method, route.path, "{}", nil); rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s in read-only mode = %d, want 405", route.method, route.path, rec.Code)
+		}
+	}
+
+	if rec := doRequest(handler, "GET", john, "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET %s in read-only mode = %d, want 200", john, rec.Code)
+	}
+}
+
+func TestDisplayNameDefaultsToNameUntilSet(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := us.Handler()
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"ana","email":"ana@example.com","name":"Ana Lopez","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.DisplayName != "Ana Lopez" {
+		t.Fatalf("display_name after create = %q, want the name", user.DisplayName)
+	}
+	path := "/users/" + user.ID
+
+	// patch sends a PATCH against the user's current ETag and returns the result
+	patch := func(body string) User {
+		t.Helper()
+		etag := doRequest(handler, "GET", path, "", nil).Header().Get("ETag")
+		rec := doRequest(handler, "PATCH", path, body, map[string]string{"If-Match": etag})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("PATCH %s = %d, want 200: %s", body, rec.Code, rec.Body.String())
+		}
+		var patched User
+		decodeBody(t, rec, &patched)
+		return patched
+	}
+
+	if got := patch(`{"name":"Ana Lopez Garcia"}`).DisplayName; got != "Ana Lopez Garcia" {
+		t.Errorf("display_name after renaming = %q, want it to follow the name", got)
+	}
+	if got := patch(`{"display_name":"Ana"}`); got.DisplayName != "Ana" || got.Name != "Ana Lopez Garcia" {
+		t.Errorf("after setting display_name: name %q, display_name %q", got.Name, got.DisplayName)
+	}
+	if got := patch(`{"name":"Ana L. Garcia"}`).DisplayName; got != "Ana" {
+		t.Errorf("display_name after renaming = %q, want the explicit value kept", got)
+	}
+	if got := patch(`{"display_name":""}`).DisplayName; got != "Ana L. Garcia" {
+		t.Errorf("display_name after clearing = %q, want the name again", got)
+	}
+}
+
+func TestConcatenatedJSONDocumentsAreRejected(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"ADMIN_ENDPOINTS": "true"})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+
+	routes := []struct {
+		method, path, body string
+	}{
+		{"POST", "/users", `{"username":"a","email":"a@example.com","role":"customer"} {"username":"b","email":"b@example.com","role":"customer"}`},
+		{"POST", "/users/batch", `[] []`},
+		{"PUT", john, `{"username":"john_doe","email":"john@example.com","role":"customer"} {}`},
+		{"PATCH", john, `{"name":"John"} {"name":"Johnny"}`},
+		{"PUT", "/admin/maintenance", `{"enabled":true} {"enabled":false}`},
+	}
+	for _, route := range routes {
+		rec := doRequest(handler, route.method, route.path, route.body, map[string]string{"If-Match": etag})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s with two documents = %d, want 400", route.method, route.path, rec.Code)
+			continue
+		}
+		var body map[string]string
+		decodeBody(t, rec, &body)
+		if body["code"] != "MULTIPLE_JSON_DOCUMENTS" {
+			t.Errorf("%s %s code = %q, want MULTIPLE_JSON_DOCUMENTS", route.method, route.path, body["code"])
+		}
+	}
+
+	if us.maintenance.Load() {
+		t.Error("maintenance mode was changed by a rejected body")
+	}
+	if rec := doRequest(handler, "POST", "/users", `{"username":"a","email":"a@example.com","role":"customer"}`+"\n\n", nil); rec.Code != http.StatusCreated {
+		t.Errorf("POST /users with trailing whitespace = %d, want 201", rec.Code)
+	}
+}
+
+// createConcurrently posts each body to /users at the same moment and
+// returns the response codes
+func createConcurrently(handler http.Handler, bodies ...string) []int {
+	codes := make([]int, len(bodies))
+	ready := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func(i int, body string) {
+			defer wg.Done()
+			<-ready
+			codes[i] = doRequest(handler, "POST", "/users", body, nil).Code
+		}(i, body)
+	}
+	close(ready)
+	wg.Wait()
+	return codes
+}
+
+func TestConcurrentCreatesWithSameEmail(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	for round := 0; round < 20; round++ {
+		email := fmt.Sprintf("race%d@example.com", round)
+		codes := createConcurrently(handler,
+			fmt.Sprintf(`{"username":"first%d","email":%q,"role":"customer"}`, round, email),
+			fmt.Sprintf(`{"username":"second%d","email":%q,"role":"customer"}`, round, strings.ToUpper(email)),
+		)
+		sort.Ints(codes)
+		if codes[0] != http.StatusCreated || codes[1] != http.StatusConflict {
+			t.Fatalf("round %d: concurrent creates with one email = %v, want one 201 and one 409", round, codes)
+		}
+	}
+}
+
+func TestConcurrentCreatesWithSameUsername(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	for round := 0; round < 20; round++ {
+		codes := createConcurrently(handler,
+			fmt.Sprintf(`{"username":"racer%d","email":"a%d@example.com","role":"customer"}`, round, round),
+			fmt.Sprintf(`{"username":"racer%d","email":"b%d@example.com","role":"customer"}`, round, round),
+		)
+		sort.Ints(codes)
+		if codes[0] != http.StatusCreated || codes[1] != http.StatusConflict {
+			t.Fatalf("round %d: concurrent creates with one username = %v, want one 201 and one 409", round, codes)
+		}
+	}
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"racer0","email":"c@example.com","role":"customer"}`, nil)
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusConflict || body["field"] != "username" {
+		t.Errorf("duplicate username = %d %v, want 409 naming the username field", rec.Code, body)
+	}
+}
+
+func TestCaseInsensitiveUsernames(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"USERNAME_CASE_INSENSITIVE": "true",
+		"RATE_LIMIT_RPS":            "0",
+	})
+	handler := us.Handler()
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"Admin","email":"other@example.com","role":"customer"}`, nil)
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusConflict || body["field"] != "username" {
+		t.Errorf("creating Admin next to admin = %d %v, want 409 naming the username field", rec.Code, body)
+	}
+
+	rec = doRequest(handler, "POST", "/users", `{"username":"MixedCase","email":"mixed@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+
+	// Lookups ignore case and return the username as it was entered
+	rec = doRequest(handler, "GET", "/users/search?username=mixedcase", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("search for mixedcase = %d, want 200", rec.Code)
+	}
+	var found User
+	decodeBody(t, rec, &found)
+	if found.Username != "MixedCase" {
+		t.Errorf("found username = %q, want MixedCase", found.Username)
+	}
+}
+
+func TestUsernamesAreCaseSensitiveByDefault(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"Admin","email":"other@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("creating Admin next to admin = %d, want 201", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users/search?username=ADMIN", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("search for ADMIN = %d, want 404", rec.Code)
+	}
+}
+
+// writeCountingRecorder counts the writes reaching the response, which stand
+// in for syscalls on a real connection
+type writeCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *writeCountingRecorder) Write(b []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(b)
+}
+
+func benchmarkListEncoding(b *testing.B, bufferSize int) {
+	users := make([]User, 10000)
+	for i := range users {
+		users[i] = User{
+			ID:       fmt.Sprintf("%08d-0000-4000-8000-000000000000", i),
+			Username: fmt.Sprintf("user%d", i),
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Name:     "Bench User",
+			Role:     "customer",
+		}
+	}
+	page := userPage{Users: users, Total: len(users), Limit: len(users)}
+	// json.Encoder already writes each value in one call; the msgpack
+	// encoder writes field by field, which is where buffering pays off
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "application/msgpack")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var writes int
+	for i := 0; i < b.N; i++ {
+		w := &writeCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if err := writeNegotiatedBuffered(w, req, http.StatusOK, page, bufferSize); err != nil {
+			b.Fatal(err)
+		}
+		writes += w.writes
+	}
+	b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkListEncodingUnbuffered(b *testing.B) {
+	benchmarkListEncoding(b, 0)
+}
+
+func BenchmarkListEncodingBuffered(b *testing.B) {
+	benchmarkListEncoding(b, 32*1024)
+}
+
+func TestPanickingHandlerGetsA500(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	router := mux.NewRouter()
+	router.Use(us.recoverMiddleware)
+	router.Use(requestIDMiddleware)
+	router.HandleFunc("/boom/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("deliberate")
+	})
+
+	rec := doRequest(router, "GET", "/boom/1", "", nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("GET /boom/1 = %d, want 500", rec.Code)
+	}
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if body["error"] != "internal server error" {
+		t.Errorf("panic response body = %v", body)
+	}
+	if rec.Header().Get(requestIDHeader) == "" {
+		t.Error("panic response has no request ID")
+	}
+
+	if got := testutil.ToFloat64(us.panicsTotal); got != 1 {
+		t.Errorf("panics_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(us.requestsTotal.WithLabelValues("GET", "/boom/{id}", "500")); got != 1 {
+		t.Errorf("requests counted as 500 = %v, want 1", got)
+	}
+}
+
+func TestPanicDetailsOnlyWithDebugErrors(t *testing.T) {
+	for _, debugErrors := range []bool{false, true} {
+		us, _ := newTestService(t, nil)
+		us.config.debugErrors = debugErrors
+		router := mux.NewRouter()
+		router.Use(us.recoverMiddleware)
+		router.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+			panic("deliberate")
+		})
+
+		rec := doRequest(router, "GET", "/boom", "", nil)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("debugErrors=%v: GET /boom = %d, want 500", debugErrors, rec.Code)
+		}
+		var body map[string]string
+		decodeBody(t, rec, &body)
+
+		if debugErrors {
+			if body["panic"] != "deliberate" {
+				t.Errorf("debug panic = %q, want deliberate", body["panic"])
+			}
+			if !strings.Contains(body["stack"], "goroutine") {
+				t.Errorf("debug stack = %q, want a stack trace", body["stack"])
+			}
+			continue
+		}
+		if _, ok := body["panic"]; ok {
+			t.Errorf("panic message leaked without DEBUG_ERRORS: %v", body)
+		}
+		if _, ok := body["stack"]; ok {
+			t.Errorf("stack trace leaked without DEBUG_ERRORS: %v", body)
+		}
+	}
+}
+
+func TestDebugErrorsFromEnv(t *testing.T) {
+	cfg, err := loadHandlerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.debugErrors {
+		t.Error("debugErrors is on by default")
+	}
+
+	t.Setenv("DEBUG_ERRORS", "true")
+	if cfg, err = loadHandlerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.debugErrors {
+		t.Error("DEBUG_ERRORS=true did not enable debugErrors")
+	}
+}
+
+func TestUpdateMaskOnlyAppliesListedFields(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	body := `{"username":"ignored","email":"johnny@example.com","name":"Johnny","role":"admin"}`
+	anyVersion := map[string]string{"If-Match": "*"}
+
+	rec := doRequest(handler, "PUT", john+"?update_mask=email,name", body, anyVersion)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("masked PUT = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.Email != "johnny@example.com" || user.Name != "Johnny" {
+		t.Errorf("masked fields = %q %q, want the body's values", user.Email, user.Name)
+	}
+	if user.Username != "john_doe" || user.Role != "customer" {
+		t.Errorf("unmasked fields = %q %q, want them unchanged", user.Username, user.Role)
+	}
+
+	// A mask may leave out fields that are otherwise required
+	rec = doRequest(handler, "PUT", john+"?update_mask=name", `{"name":"John"}`, anyVersion)
+	if rec.Code != http.StatusOK {
+		t.Errorf("PUT masking only name = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	for _, mask := range []string{"nickname", "email,id", "created"} {
+		rec := doRequest(handler, "PUT", john+"?update_mask="+mask, body, anyVersion)
+		var errBody map[string]string
+		decodeBody(t, rec, &errBody)
+		if rec.Code != http.StatusBadRequest || errBody["field"] != "update_mask" {
+			t.Errorf("PUT with update_mask=%s = %d %v, want 400 naming update_mask", mask, rec.Code, errBody)
+		}
+	}
+
+	// Masked values are still validated and checked for conflicts
+	rec = doRequest(handler, "PUT", john+"?update_mask=email", `{"email":"not-an-email"}`, anyVersion)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("masked invalid email = %d, want 400", rec.Code)
+	}
+	rec = doRequest(handler, "PUT", john+"?update_mask=username", `{"username":"admin"}`, anyVersion)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("masked duplicate username = %d, want 409", rec.Code)
+	}
+}
+
+func TestStaleETagLosesUpdateRace(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	// Both clients read the same version
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET has no ETag")
+	}
+
+	first := doRequest(handler, "PATCH", john, `{"name":"First Writer"}`, map[string]string{"If-Match": etag})
+	if first.Code != http.StatusOK {
+		t.Fatalf("first PATCH = %d, want 200", first.Code)
+	}
+	if first.Header().Get("ETag") == etag {
+		t.Error("ETag unchanged after an update")
+	}
+
+	second := doRequest(handler, "PUT", john, `{"username":"john_doe","email":"john@example.com","name":"Second Writer","role":"customer"}`, map[string]string{"If-Match": etag})
+	if second.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with the stale ETag = %d, want 412", second.Code)
+	}
+	var user User
+	decodeBody(t, doRequest(handler, "GET", john, "", nil), &user)
+	if user.Name != "First Writer" {
+		t.Errorf("name after the race = %q, want the first writer's", user.Name)
+	}
+
+	if rec := doRequest(handler, "PATCH", john, `{"name":"No Precondition"}`, nil); rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("PATCH without If-Match = %d, want 428", rec.Code)
+	}
+}
+
+func TestIfUnmodifiedSinceOnUpdates(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	var user User
+	decodeBody(t, doRequest(handler, "GET", john, "", nil), &user)
+	updated, err := time.Parse(time.RFC3339, user.Updated)
+	if err != nil {
+		t.Fatalf("parsing Updated %q: %v", user.Updated, err)
+	}
+	stale := map[string]string{"If-Unmodified-Since": updated.Add(-time.Hour).UTC().Format(http.TimeFormat)}
+	fresh := map[string]string{"If-Unmodified-Since": updated.UTC().Format(http.TimeFormat)}
+
+	if rec := doRequest(handler, "PATCH", john, `{"name":"Stale"}`, stale); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a stale If-Unmodified-Since = %d, want 412", rec.Code)
+	}
+	put := `{"username":"john_doe","email":"john@example.com","name":"Stale","role":"customer"}`
+	if rec := doRequest(handler, "PUT", john, put, stale); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Unmodified-Since = %d, want 412", rec.Code)
+	}
+
+	us.clock = &fakeClock{now: updated.Add(time.Hour)}
+	if rec := doRequest(handler, "PATCH", john, `{"name":"Fresh"}`, fresh); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH with a fresh If-Unmodified-Since = %d, want 200", rec.Code)
+	}
+
+	// The write moved Updated past the old date, so it is now stale
+	if rec := doRequest(handler, "PUT", john, put, fresh); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT after another write = %d, want 412", rec.Code)
+	}
+
+	// If-Match wins when both are sent
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+	both := map[string]string{"If-Match": etag, "If-Unmodified-Since": stale["If-Unmodified-Since"]}
+	if rec := doRequest(handler, "PATCH", john, `{"name":"Both"}`, both); rec.Code != http.StatusOK {
+		t.Errorf("PATCH with a matching If-Match and stale If-Unmodified-Since = %d, want 200", rec.Code)
+	}
+}
+
+func TestConcurrentUpdatesWithOneETag(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+
+	codes := make([]int, 2)
+	ready := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-ready
+			body := fmt.Sprintf(`{"name":"Writer %d"}`, i)
+			codes[i] = doRequest(handler, "PATCH", john, body, map[string]string{"If-Match": etag}).Code
+		}(i)
+	}
+	close(ready)
+	wg.Wait()
+
+	sort.Ints(codes)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusPreconditionFailed {
+		t.Errorf("concurrent PATCHes with one ETag = %v, want one 200 and one 412", codes)
+	}
+}
+
+func TestJSONExportPresentsDefaultDisplayNames(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	rec := doRequest(us.Handler(), "GET", "/users/export?format=json", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users/export?format=json = %d, want 200", rec.Code)
+	}
+	var users []User
+	decodeBody(t, rec, &users)
+	for _, user := range users {
+		if user.DisplayName != user.Name {
+			t.Errorf("exported %s with display_name %q, want the name %q", user.Username, user.DisplayName, user.Name)
+		}
+	}
+}
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestCreatedComesFromTheClock(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	us.clock = &fakeClock{now: time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)}
+	const want = "2024-03-01T12:30:45Z"
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"timed","email":"timed@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.Created != want || user.Updated != want {
+		t.Errorf("created %q updated %q, want both %q", user.Created, user.Updated, want)
+	}
+
+	rec = doRequest(handler, "POST", "/users/batch", `[{"username":"batched","email":"batched@example.com","role":"customer"}]`, nil)
+	var results []batchResult
+	decodeBody(t, rec, &results)
+	if len(results) != 1 || results[0].User == nil || results[0].User.Created != want {
+		t.Errorf("batch results = %+v, want one user created at %q", results, want)
+	}
+
+	if loc := (systemClock{}).Now().Location(); loc != time.UTC {
+		t.Errorf("systemClock location = %v, want UTC", loc)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"EMAIL_VERIFICATION_SECRET": "verify-secret",
+		"RATE_LIMIT_RPS":            "0",
+	})
+	handler := us.Handler()
+
+	// The client can't mark a new user verified itself
+	rec := doRequest(handler, "POST", "/users", `{"username":"fresh","email":"fresh@example.com","role":"customer","email_verified":true}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.EmailVerified {
+		t.Error("new user starts out verified")
+	}
+	path := "/users/" + user.ID + "/verify-email"
+
+	if rec := doRequest(handler, "POST", path, `{"token":"forged"}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("verify with a forged token = %d, want 400", rec.Code)
+	}
+
+	token := us.emailVerificationToken(user)
+	rec = doRequest(handler, "POST", path, `{"token":"`+token+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify with the real token = %d, want 200", rec.Code)
+	}
+	decodeBody(t, rec, &user)
+	if !user.EmailVerified {
+		t.Error("user not verified after a valid token")
+	}
+	decodeBody(t, doRequest(handler, "GET", "/users/"+user.ID, "", nil), &user)
+	if !user.EmailVerified {
+		t.Error("verification was not stored")
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"verified=true", []string{"fresh"}},
+		{"verified=false", []string{"admin", "jane_smith", "john_doe"}},
+	} {
+		var page userPage
+		decodeBody(t, doRequest(handler, "GET", "/users?"+tt.query, "", nil), &page)
+		var names []string
+		for _, u := range page.Users {
+			names = append(names, u.Username)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /users?%s = %v, want %v", tt.query, names, tt.want)
+		}
+	}
+	if rec := doRequest(handler, "GET", "/users?verified=maybe", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /users?verified=maybe = %d, want 400", rec.Code)
+	}
+
+	// Changing the email drops the verification
+	rec = doRequest(handler, "PATCH", "/users/"+user.ID, `{"email":"moved@example.com"}`, map[string]string{"If-Match": "*"})
+	decodeBody(t, rec, &user)
+	if user.EmailVerified {
+		t.Error("user still verified after an email change")
+	}
+}
+
+func TestUserIDsAreUUIDs(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		rec := doRequest(handler, "POST", "/users", fmt.Sprintf(`{"username":"id%d","email":"id%d@example.com","role":"customer"}`, i, i), nil)
+		var user User
+		decodeBody(t, rec, &user)
+		if !uuidV4.MatchString(user.ID) {
+			t.Errorf("created user ID %q is not a lowercase v4 UUID", user.ID)
+		}
+		if seen[user.ID] {
+			t.Errorf("ID %s handed out twice", user.ID)
+		}
+		seen[user.ID] = true
+		if got := rec.Header().Get("Location"); got != "" && got != userPath(user.ID) {
+			t.Errorf("Location = %q, want %q", got, userPath(user.ID))
+		}
+	}
+
+	// Users stored before the switch keep their decimal IDs
+	us.mutex.Lock()
+	us.users["42"] = User{ID: "42", Username: "legacy", Email: "legacy@example.com", Role: "customer"}
+	us.mutex.Unlock()
+	if rec := doRequest(handler, "GET", "/users/42", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET legacy /users/42 = %d, want 200", rec.Code)
+	}
+
+	for _, id := range []string{"ABCDEF01-2345-4678-89AB-CDEF01234567", "not-an-id", "42abc"} {
+		if rec := doRequest(handler, "GET", "/users/"+id, "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET /users/%s = %d, want 404", id, rec.Code)
+		}
+	}
+}
+
+func TestUsersLastModifiedFollowsNewestUpdate(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := us.Handler()
+	clock := &fakeClock{now: time.Now().UTC().Add(time.Hour).Truncate(time.Second)}
+	us.clock = clock
+
+	if rec := doRequest(handler, "POST", "/users", `{"username":"newest","email":"newest@example.com","role":"customer"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+	created := clock.now.Format(http.TimeFormat)
+
+	rec := doRequest(handler, "GET", "/users", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != created {
+		t.Fatalf("Last-Modified = %q, want the newest user's update %q", got, created)
+	}
+
+	tests := []struct {
+		since string
+		want  int
+	}{
+		{created, http.StatusNotModified},
+		{clock.now.Add(time.Minute).Format(http.TimeFormat), http.StatusNotModified},
+		{clock.now.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := doRequest(handler, "GET", "/users", "", map[string]string{"If-Modified-Since": tt.since})
+		if rec.Code != tt.want {
+			t.Errorf("If-Modified-Since %s = %d, want %d", tt.since, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("304 carried a body: %q", rec.Body.String())
+		}
+	}
+
+	// The admin wasn't touched, so a filtered list keeps its older date
+	rec = doRequest(handler, "GET", "/users?role=admin", "", map[string]string{"If-Modified-Since": created})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("admins since the create = %d, want 304", rec.Code)
+	}
+
+	// An update moves the date forward
+	clock.now = clock.now.Add(time.Minute)
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+	if rec := doRequest(handler, "PATCH", john, `{"name":"Johnny"}`, map[string]string{"If-Match": etag}); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d, want 200", rec.Code)
+	}
+	rec = doRequest(handler, "GET", "/users", "", map[string]string{"If-Modified-Since": created})
+	if rec.Code != http.StatusOK || rec.Header().Get("Last-Modified") != clock.now.Format(http.TimeFormat) {
+		t.Errorf("after an update: %d with Last-Modified %q", rec.Code, rec.Header().Get("Last-Modified"))
+	}
+
+	// A delete leaves no newer Updated behind but still changes the list
+	updated := clock.now.Format(http.TimeFormat)
+	clock.now = clock.now.Add(time.Minute)
+	if rec := doRequest(handler, "DELETE", john, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", rec.Code)
+	}
+	rec = doRequest(handler, "GET", "/users", "", map[string]string{"If-Modified-Since": updated})
+	if rec.Code != http.StatusOK {
+		t.Errorf("after a delete = %d, want 200", rec.Code)
+	}
+}
+
+func TestNegotiateMediaType(t *testing.T) {
+	offers := []string{"application/json", "application/msgpack"}
+	tests := []struct {
+		header, want string
+	}{
+		{"", "application/json"},
+		{"application/msgpack", "application/msgpack"},
+		{"application/msgpack;q=0", ""},
+		{"application/msgpack;q=0, */*", "application/json"},
+		{"application/json;q=0.5, application/msgpack", "application/msgpack"},
+		{"application/json, application/msgpack;q=0.9", "application/json"},
+		{"application/msgpack, */*", "application/msgpack"},
+		{"application/*", "application/json"},
+		{"text/html", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateMediaType(tt.header, offers...); got != tt.want {
+			t.Errorf("negotiateMediaType(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	var want User
+	decodeBody(t, doRequest(handler, "GET", john, "", nil), &want)
+
+	rec := doRequest(handler, "GET", john, "", map[string]string{"Accept": "application/msgpack"})
+	if got := rec.Header().Get("Content-Type"); got != "application/msgpack" {
+		t.Fatalf("Content-Type = %q, want application/msgpack", got)
+	}
+	if got := strings.Join(rec.Header().Values("Vary"), ", "); !strings.Contains(got, "Accept") {
+		t.Errorf("Vary = %q, want Accept listed", got)
+	}
+	var got User
+	dec := msgpack.NewDecoder(rec.Body)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&got); err != nil {
+		t.Fatalf("decoding msgpack: %v", err)
+	}
+	if got != want {
+		t.Errorf("msgpack user = %+v, want %+v", got, want)
+	}
+
+	// A zero quality refuses msgpack
+	rec = doRequest(handler, "GET", john, "", map[string]string{"Accept": "application/msgpack;q=0, application/json"})
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type with msgpack;q=0 = %q, want application/json", got)
+	}
+}
+
+func TestHALLinksOnlyForHALClients(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"application/hal+json", "application/hal+json"},
+		{"application/json;q=0.5, application/hal+json", "application/hal+json"},
+		{"", "application/json"},
+		{"application/json", "application/json"},
+		{"*/*", "application/json"},
+		{"application/hal+json;q=0, application/json", "application/json"},
+		{"application/hal+json;q=0.5, application/json", "application/json"},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{john, "/users"} {
+			rec := doRequest(handler, "GET", path, "", map[string]string{"Accept": tt.accept})
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("GET %s with Accept %q Content-Type = %q, want %q", path, tt.accept, got, tt.contentType)
+			}
+			hasLinks := strings.Contains(rec.Body.String(), `"_links"`)
+			if wantLinks := tt.contentType == "application/hal+json"; hasLinks != wantLinks {
+				t.Errorf("GET %s with Accept %q has _links = %v, want %v", path, tt.accept, hasLinks, wantLinks)
+			}
+		}
+	}
+
+	var user struct {
+		Links map[string]halLink `json:"_links"`
+	}
+	decodeBody(t, doRequest(handler, "GET", john, "", map[string]string{"Accept": "application/hal+json"}), &user)
+	if got := user.Links["self"].Href; got != john {
+		t.Errorf("self link = %q, want %q", got, john)
+	}
+}
+
+func TestMaintenanceModeKeepsHealthUp(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"MAINTENANCE_MODE": "true",
+		"ADMIN_ENDPOINTS":  "true",
+		"RATE_LIMIT_RPS":   "0",
+	})
+	handler := us.Handler()
+	john := "/users/" + userIDByName(t, us, "john_doe")
+
+	for _, route := range []struct{ method, path, body string }{
+		{"GET", "/users", ""},
+		{"GET", john, ""},
+		{"GET", "/users/search?username=john_doe", ""},
+		{"POST", "/users", `{"username":"new","email":"new@example.com","role":"customer"}`},
+		{"DELETE", john, ""},
+	} {
+		rec := doRequest(handler, route.method, route.path, route.body, nil)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s in maintenance = %d (Retry-After %q), want 503 with Retry-After", route.method, route.path, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+
+	probes := map[string]int{"/health": http.StatusOK, "/ready": http.StatusServiceUnavailable, "/metrics": http.StatusOK}
+	for path, want := range probes {
+		if rec := doRequest(handler, "GET", path, "", nil); rec.Code != want {
+			t.Errorf("GET %s in maintenance = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	// The admin toggle stays reachable and brings the API back
+	if rec := doRequest(handler, "PUT", "/admin/maintenance", `{"enabled":false}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/maintenance = %d, want 200", rec.Code)
+	}
+	for _, path := range []string{"/users", "/ready"} {
+		if rec := doRequest(handler, "GET", path, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("GET %s after maintenance = %d, want 200", path, rec.Code)
+		}
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query         string
+		limit, offset int
+		wantErr       bool
+	}{
+		{"", defaultPageLimit, 0, false},
+		{"limit=10&offset=20", 10, 20, false},
+		{"limit=0", 0, 0, false},
+		{"limit=" + strconv.Itoa(maxPageLimit+1), maxPageLimit, 0, false},
+		{"limit=-1", 0, 0, true},
+		{"limit=ten", 0, 0, true},
+		{"offset=-5", 0, 0, true},
+		{"offset=1.5", 0, 0, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/users?"+tt.query, nil)
+		limit, offset, err := parsePagination(req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (limit != tt.limit || offset != tt.offset) {
+			t.Errorf("%q = limit %d offset %d, want %d %d", tt.query, limit, offset, tt.limit, tt.offset)
+		}
+	}
+}
+
+func TestUserPagesCoverEveryUserOnce(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "0"})
+	handler := us.Handler()
+	for _, name := range []string{"dave", "erin"} {
+		doRequest(handler, "POST", "/users", `{"username":"`+name+`","email":"`+name+`@example.com","role":"customer"}`, nil)
+	}
+
+	seen := make(map[string]bool)
+	for _, tt := range []struct{ offset, size int }{{0, 2}, {2, 2}, {4, 1}, {5, 0}, {50, 0}} {
+		rec := doRequest(handler, "GET", fmt.Sprintf("/users?limit=2&offset=%d", tt.offset), "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("offset %d = %d, want 200", tt.offset, rec.Code)
+		}
+		if tt.size == 0 && !strings.Contains(rec.Body.String(), `"users":[]`) {
+			t.Errorf("offset %d: empty page is not encoded as []: %s", tt.offset, rec.Body)
+		}
+		var page userPage
+		decodeBody(t, rec, &page)
+		if len(page.Users) != tt.size || page.Total != 5 || page.Limit != 2 || page.Offset != tt.offset {
+			t.Errorf("offset %d = %d users, total %d, limit %d, offset %d; want %d users of 5", tt.offset, len(page.Users), page.Total, page.Limit, page.Offset, tt.size)
+		}
+		for _, user := range page.Users {
+			if seen[user.ID] {
+				t.Errorf("user %s appears on two pages", user.Username)
+			}
+			seen[user.ID] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("pages covered %d users, want all 5", len(seen))
+	}
+
+	if rec := doRequest(handler, "GET", "/users?limit=-1", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /users?limit=-1 = %d, want 400", rec.Code)
+	}
+}
+
+func TestValidateUserReportsEachField(t *testing.T) {
+	required := map[string]bool{"username": true, "email": true, "name": true}
+	valid := User{Username: "jay", Email: "jay@example.com", Name: "Jay", Role: "customer"}
+
+	tests := []struct {
+		name  string
+		user  func(u *User)
+		field string
+	}{
+		{"missing username", func(u *User) { u.Username = "" }, "username"},
+		{"blank username", func(u *User) { u.Username = "   " }, "username"},
+		{"missing email", func(u *User) { u.Email = "" }, "email"},
+		{"missing name", func(u *User) { u.Name = "\t" }, "name"},
+		{"email without at", func(u *User) { u.Email = "jay.example.com" }, "email"},
+		{"email without dotted domain", func(u *User) { u.Email = "jay@localhost" }, "email"},
+		{"email with space", func(u *User) { u.Email = "j ay@example.com" }, "email"},
+		{"email with double at", func(u *User) { u.Email = "jay@@example.com" }, "email"},
+		{"unknown role", func(u *User) { u.Role = "superuser" }, "role"},
+		{"missing role", func(u *User) { u.Role = "" }, "role"},
+		{"role in the wrong case", func(u *User) { u.Role = "Admin" }, "role"},
+	}
+	for _, tt := range tests {
+		user := valid
+		tt.user(&user)
+		err := validateUser(user, required)
+		var validationErr *validationError
+		if !errors.As(err, &validationErr) || validationErr.Field != tt.field {
+			t.Errorf("%s: got %v, want an error on %s", tt.name, err, tt.field)
+		}
+	}
+
+	for _, role := range []string{"admin", "customer"} {
+		user := valid
+		user.Role = role
+		if err := validateUser(user, required); err != nil {
+			t.Errorf("role %s rejected: %v", role, err)
+		}
+	}
+
+	// Fields left out of the required set may be empty, but an email that is
+	// given must still be valid
+	optional := User{Role: "customer"}
+	if err := validateUser(optional, nil); err != nil {
+		t.Errorf("user with only a role rejected with nothing required: %v", err)
+	}
+	optional.Email = "nope"
+	if err := validateUser(optional, nil); err == nil {
+		t.Error("invalid optional email accepted")
+	}
+}
+
+func TestValidateUserRejectsInvalidUTF8(t *testing.T) {
+	valid := User{Username: "jay", Email: "jay@example.com", Name: "Jay", Role: "customer"}
+	if err := validateUser(valid, nil); err != nil {
+		t.Fatalf("valid user rejected: %v", err)
+	}
+
+	invalid := "J\xffay"
+	tests := map[string]func(u *User){
+		"username":     func(u *User) { u.Username = invalid },
+		"email":        func(u *User) { u.Email = "j\xff@example.com" },
+		"name":         func(u *User) { u.Name = invalid },
+		"display_name": func(u *User) { u.DisplayName = invalid },
+		"role":         func(u *User) { u.Role = "\xc3" },
+	}
+	for field, corrupt := range tests {
+		user := valid
+		corrupt(&user)
+		err := validateUser(user, nil)
+		var validationErr *validationError
+		if !errors.As(err, &validationErr) || validationErr.Field != field || !strings.Contains(validationErr.Message, "UTF-8") {
+			t.Errorf("invalid UTF-8 in %s gave %v", field, err)
+		}
+	}
+
+	// Multi-byte characters are fine
+	valid.Name = "Jöürgen 李"
+	if err := validateUser(valid, nil); err != nil {
+		t.Errorf("valid multi-byte name rejected: %v", err)
+	}
+}
+
+func TestOpenAPISpecIsServedAndListsRoutes(t *testing.T) {
+	// The spec stays public even when authentication is on
+	us, _ := newTestService(t, map[string]string{"JWT_SECRET": "s3cret"})
+
+	rec := doRequest(us.Handler(), "GET", "/openapi.json", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json = %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	decodeBody(t, rec, &spec)
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi version = %q", spec.OpenAPI)
+	}
+	for _, path := range []string{"/users", "/users/{id}", "/users/batch", "/users/search", "/users/export"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("spec is missing %s", path)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	original := User{ID: "u1", Username: "jay", Email: "jay@example.com", Name: "Jay", DisplayName: "J", Role: "customer"}
+	patchOf := func(body string) map[string]json.RawMessage {
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(body), &patch); err != nil {
+			t.Fatalf("bad patch %s: %v", body, err)
+		}
+		return patch
+	}
+
+	// Omitted fields stay as they were; unknown fields are ignored
+	user := original
+	if err := applyPatch(&user, patchOf(`{"name":"Jay Z","nickname":"jz"}`)); err != nil {
+		t.Fatalf("applyPatch: %v", err)
+	}
+	want := original
+	want.Name = "Jay Z"
+	if user != want {
+		t.Errorf("patched user = %+v, want %+v", user, want)
+	}
+
+	// An explicit empty string is a value, not an omission
+	user = original
+	if err := applyPatch(&user, patchOf(`{"display_name":""}`)); err != nil {
+		t.Fatalf("applyPatch: %v", err)
+	}
+	if user.DisplayName != "" || user.Name != original.Name {
+		t.Errorf("patched user = %+v", user)
+	}
+
+	rejected := map[string]struct {
+		field, message string
+	}{
+		`{"email":null}`:                     {"email", "email cannot be null"},
+		`{"role":7}`:                         {"role", "role must be a string"},
+		`{"id":"u2"}`:                        {"id", "id cannot be changed"},
+		`{"created":"2020-01-01T00:00:00Z"}`: {"created", "created cannot be changed"},
+		`{"email_verified":true}`:            {"email_verified", "email_verified cannot be changed"},
+	}
+	for body, want := range rejected {
+		user := original
+		err := applyPatch(&user, patchOf(body))
+		var validationErr *validationError
+		if !errors.As(err, &validationErr) || validationErr.Field != want.field || validationErr.Message != want.message {
+			t.Errorf("applyPatch(%s) = %v, want %s", body, err, want.message)
+		}
+	}
+}
+
+func TestRequiredUserFields(t *testing.T) {
+	us, _ := newTestService(t, nil)
+	if want := map[string]bool{"username": true, "email": true}; !reflect.DeepEqual(us.requiredFields, want) {
+		t.Errorf("default required fields = %v, want %v", us.requiredFields, want)
+	}
+	rec := doRequest(us.Handler(), "POST", "/users", `{"username":"noemail","role":"customer"}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST without email = %d, want 400", rec.Code)
+	}
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if body["field"] != "email" {
+		t.Errorf("error field = %q, want email", body["field"])
+	}
+
+	// Names are case-insensitive and unknown ones are dropped
+	us, _ = newTestService(t, map[string]string{"REQUIRED_USER_FIELDS": "Name, role"})
+	if want := map[string]bool{"name": true}; !reflect.DeepEqual(us.requiredFields, want) {
+		t.Errorf("overridden required fields = %v, want %v", us.requiredFields, want)
+	}
+	handler := us.Handler()
+	if rec := doRequest(handler, "POST", "/users", `{"username":"noemail","name":"No Email","role":"customer"}`, nil); rec.Code != http.StatusCreated {
+		t.Errorf("POST without email = %d, want 201: %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(handler, "POST", "/users", `{"username":"noname","email":"noname@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST without name = %d, want 400", rec.Code)
+	}
+	decodeBody(t, rec, &body)
+	if body["field"] != "name" || body["error"] != "Name is required" {
+		t.Errorf("error body = %v", body)
+	}
+}
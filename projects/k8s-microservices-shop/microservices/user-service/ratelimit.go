@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// rateLimitSweepInterval is how often idle buckets are evicted
+const rateLimitSweepInterval = time.Minute
+
+// ipRateLimiter keeps a token bucket per client IP. Buckets are created on a
+// client's first request and evicted once they have refilled completely.
+type ipRateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	limited   prometheus.Counter
+}
+
+func newIPRateLimiter(rate float64, burst int, limited prometheus.Counter) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		limited:   limited,
+	}
+}
+
+// allow takes a token from the client's bucket. When none is left it
+// returns false and how long the client should wait before retrying.
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for key, bucket := range l.buckets {
+			if bucket.idleFor(now) {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = newTokenBucket(l.rate, l.burst)
+		bucket.last = now
+		l.buckets[ip] = bucket
+	}
+
+	if bucket.take(now) {
+		return true, 0
+	}
+	return false, bucket.retryAfter()
+}
+
+// rateLimitError is the body of a 429, describing the quota that was hit
+type rateLimitError struct {
+	Error     string `json:"error"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Reset     int64  `json:"reset"`
+	Scope     string `json:"scope"`
+}
+
+// Middleware answering 429 once a client exceeds its request rate. Clients
+// are identified by clientIP, which only honours forwarding headers from
+// trusted proxies, so spoofed headers can't mint fresh buckets.
+func (l *ipRateLimiter) middleware(logger *logrus.Logger, clientIP func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			now := time.Now()
+			allowed, wait := l.allow(ip, now)
+			if allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			l.limited.Inc()
+			logger.WithFields(logrus.Fields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"ip":         ip,
+				"request_id": requestIDFromContext(r.Context()),
+			}).Warn("Rate limit exceeded")
+
+			// Clients get a token back by the reset time; reporting it in both
+			// headers and body lets them back off without guessing
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			reset := now.Add(time.Duration(retryAfter) * time.Second).Unix()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.burst))
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(rateLimitError{
+				Error:     "Too many requests, please retry later",
+				Limit:     l.burst,
+				Remaining: 0,
+				Reset:     reset,
+				Scope:     "ip",
+			})
+		})
+	}
+}
+
+// limitBulk wraps a bulk endpoint so at most MAX_CONCURRENT_BULK bulk
+// requests run at once across all of them. Requests over the limit get a 429
+// straight away rather than queueing.
+func (us *UserService) limitBulk(next http.Handler) http.Handler {
+	if us.bulkSlots == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case us.bulkSlots <- struct{}{}:
+			defer func() { <-us.bulkSlots }()
+			next.ServeHTTP(w, r)
+			return
+		default:
+		}
+
+		us.requestsTotal.WithLabelValues(r.Method, routeEndpoint(r), "429").Inc()
+		us.requestLogger(r).WithFields(logrus.Fields{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"limit":  cap(us.bulkSlots),
+		}).Warn("Too many concurrent bulk operations")
+
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many bulk operations in progress, please retry later"})
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "1"})
+	handler := us.Handler()
+
+	// Without trusted proxies every request from the same socket shares a
+	// bucket, whatever X-Forwarded-For claims
+	first := doRequest(handler, "GET", "/users", "", map[string]string{"X-Forwarded-For": "203.0.113.1"})
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", first.Code)
+	}
+	second := doRequest(handler, "GET", "/users", "", map[string]string{"X-Forwarded-For": "203.0.113.2"})
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request with a rotated X-Forwarded-For = %d, want 429", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Error("429 response has no Retry-After header")
+	}
+}
+
+func TestRateLimitHonoursForwardedForFromTrustedProxy(t *testing.T) {
+	// httptest requests come from 192.0.2.1
+	us, _ := newTestService(t, map[string]string{
+		"RATE_LIMIT_RPS":   "1",
+		"RATE_LIMIT_BURST": "1",
+		"TRUSTED_PROXIES":  "192.0.2.0/24",
+	})
+	handler := us.Handler()
+
+	for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+		rec := doRequest(handler, "GET", "/users", "", map[string]string{"X-Forwarded-For": client})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("first request from %s = %d, want 200", client, rec.Code)
+		}
+	}
+
+	rec := doRequest(handler, "GET", "/users", "", map[string]string{"X-Forwarded-For": "203.0.113.1"})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("repeat request from 203.0.113.1 = %d, want 429", rec.Code)
+	}
+}
+
+func TestClientIPSkipsTrustedHops(t *testing.T) {
+	us := &UserService{}
+	us.trustedProxies, _ = parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"198.51.100.7:4000", "203.0.113.9", "198.51.100.7"},
+		{"192.0.2.1:4000", "", "192.0.2.1"},
+		{"192.0.2.1:4000", "203.0.113.9", "203.0.113.9"},
+		{"192.0.2.1:4000", "1.2.3.4, 203.0.113.9, 10.1.2.3", "203.0.113.9"},
+		{"192.0.2.1:4000", "10.1.2.3, 10.4.5.6", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := us.clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%s, XFF %q) = %q, want %q", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitedResponseDescribesTheQuota(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "2"})
+	handler := us.Handler()
+
+	for i := 0; i < 2; i++ {
+		if rec := doRequest(handler, "GET", "/users", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i+1, rec.Code)
+		}
+	}
+	before := time.Now().Unix()
+	rec := doRequest(handler, "GET", "/users", "", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request = %d, want 429", rec.Code)
+	}
+
+	if got := rec.Header().Get("X-RateLimit-Limit"); got != "2" {
+		t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+	}
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining = %q, want 0", got)
+	}
+	reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset <= before || reset > before+2 {
+		t.Errorf("X-RateLimit-Reset = %q, want a Unix time within two seconds of %d", rec.Header().Get("X-RateLimit-Reset"), before)
+	}
+
+	var body rateLimitError
+	decodeBody(t, rec, &body)
+	if body.Error == "" || body.Limit != 2 || body.Remaining != 0 || body.Reset != reset || body.Scope != "ip" {
+		t.Errorf("429 body = %+v, want limit 2, remaining 0, reset %d, scope ip", body, reset)
+	}
+}
+
+func TestBulkConcurrencyLimit(t *testing.T) {
+	us, _ := newTestService(t, map[string]string{
+		"MAX_CONCURRENT_BULK": "2",
+		"RATE_LIMIT_RPS":      "0",
+	})
+	handler := us.Handler()
+	batch := `[{"username":"bulk","email":"bulk@example.com","role":"customer"}]`
+
+	// Hold every slot, as two long-running bulk requests would
+	us.bulkSlots <- struct{}{}
+	us.bulkSlots <- struct{}{}
+
+	if rec := doRequest(handler, "POST", "/users/batch", batch, nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("batch create with the bulk limit reached = %d, want 429", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users/export", "", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("export with the bulk limit reached = %d, want 429", rec.Code)
+	}
+	rec := doRequest(handler, "POST", "/users", `{"username":"single","email":"single@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("single create with the bulk limit reached = %d, want 201", rec.Code)
+	}
+
+	<-us.bulkSlots
+	if rec := doRequest(handler, "POST", "/users/batch", batch, nil); rec.Code == http.StatusTooManyRequests {
+		t.Error("batch create still rejected after a slot was freed")
+	}
+	if len(us.bulkSlots) != 1 {
+		t.Errorf("%d bulk slots held after the batch finished, want 1", len(us.bulkSlots))
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// User keys carry the user's ID as a Redis Cluster hash tag, e.g.
+	// "user:{id}", so users spread over the cluster. Every command touching
+	// a record or an index entry names a single key, so none of them span
+	// slots.
+	userKeyPrefix = "user:{"
+
+	// Secondary indexes map a unique field to the owning user's ID. Each
+	// value is its own hash tag and is claimed with single-key commands.
+	emailIndexPrefix    = "idx:email:{"
+	usernameIndexPrefix = "idx:username:{"
+
+	// storeTimeout bounds a single Redis round trip made on behalf of a request
+	storeTimeout = 2 * time.Second
+
+	// userLockStripes is the number of locks writes to single users are
+	// spread over
+	userLockStripes = 64
+)
+
+// userKey is the Redis key holding a user's JSON record
+func userKey(id string) string {
+	return userKeyPrefix + id + "}"
+}
+
+// emailIndexKey is the index key for an email; emails are unique
+// case-insensitively, so the key is lowercased
+func emailIndexKey(email string) string {
+	return emailIndexPrefix + strings.ToLower(email) + "}"
+}
+
+// usernameIndexKey is the index key for a username. With
+// USERNAME_CASE_INSENSITIVE the key is lowercased, like an email's, while
+// the user record keeps the username as entered.
+func (us *UserService) usernameIndexKey(username string) string {
+	if us.foldUsernames {
+		username = strings.ToLower(username)
+	}
+	return usernameIndexPrefix + username + "}"
+}
+
+// lockUser serialises writes to one user, so a read-check-write such as an
+// If-Match update can run its Redis round trips without holding us.mutex.
+// It returns the matching unlock function.
+func (us *UserService) lockUser(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	lock := &us.userLocks[h.Sum32()%userLockStripes]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// setIndexes queues writes pointing u's index keys at it, overwriting any
+// current holder. Fields left empty are optional and not unique, so they
+// aren't indexed.
+func (us *UserService) setIndexes(ctx context.Context, pipe redis.Pipeliner, u User) {
+	if u.Email != "" {
+		pipe.Set(ctx, emailIndexKey(u.Email), u.ID, 0)
+	}
+	if u.Username != "" {
+		pipe.Set(ctx, us.usernameIndexKey(u.Username), u.ID, 0)
+	}
+}
+
+// indexConflictError reports that an index key is already held by another
+// user, typically one written by another replica
+type indexConflictError struct {
+	field string
+}
+
+func (e *indexConflictError) Error() string {
+	return "another user already holds this " + e.field
+}
+
+// indexClaim is an index key claimed for a user
+type indexClaim struct {
+	key string
+	id  string
+}
+
+// releaseIndexScript deletes an index key only while it still points at the
+// given user, so releasing a claim can't drop another writer's entry
+var releaseIndexScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// claimIndexes points the index keys of users at them with SETNX. The
+// in-memory uniqueness checks only see this replica's writes; the claim is
+// what keeps two replicas from handing one email or username to different
+// users. On a conflict the claims made so far are released and an
+// *indexConflictError is returned; otherwise the new claims are returned so
+// a failed write can release them.
+func (us *UserService) claimIndexes(ctx context.Context, users []User) ([]indexClaim, error) {
+	var claimed []indexClaim
+	for _, u := range users {
+		fields := []struct {
+			name, value, key string
+		}{
+			{"username", u.Username, us.usernameIndexKey(u.Username)},
+			{"email", u.Email, emailIndexKey(u.Email)},
+		}
+		for _, field := range fields {
+			if field.value == "" {
+				continue
+			}
+
+			isNew, err := us.claimIndex(ctx, field.key, u.ID)
+			if err == errIndexHeld {
+				err = &indexConflictError{field: field.name}
+			}
+			if err != nil {
+				us.releaseIndexes(ctx, claimed)
+				return nil, err
+			}
+			if isNew {
+				claimed = append(claimed, indexClaim{key: field.key, id: u.ID})
+			}
+		}
+	}
+	return claimed, nil
+}
+
+// errIndexHeld is returned by claimIndex when another user holds the key
+var errIndexHeld = errors.New("index key held by another user")
+
+// claimIndex sets key to id unless it is set already. It reports whether
+// the key was newly claimed; a key id already holds is not an error.
+func (us *UserService) claimIndex(ctx context.Context, key, id string) (bool, error) {
+	for {
+		ok, err := us.redis.SetNX(ctx, key, id, 0).Result()
+		if err != nil || ok {
+			return ok, err
+		}
+
+		holder, err := us.redis.Get(ctx, key).Result()
+		if err == redis.Nil {
+			// Released between the two commands; try again
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if holder != id {
+			return false, errIndexHeld
+		}
+		return false, nil
+	}
+}
+
+// releaseIndexes gives up index claims, either made for a write that was not
+// stored or left behind by a user's old email or username. Failures are
+// only logged; rebuildIndexes clears leftovers on startup.
+func (us *UserService) releaseIndexes(ctx context.Context, claims []indexClaim) {
+	for _, claim := range claims {
+		if err := releaseIndexScript.Run(ctx, us.redis, []string{claim.key}, claim.id).Err(); err != nil {
+			us.logger.WithError(err).WithField("key", claim.key).Warn("Failed to release index claim")
+		}
+	}
+}
+
+// saveUser claims the user's index keys, writes its record to Redis and
+// then releases the entries for its previous email and username. previous
+// is the stored version, or the zero User for a new one. Callers updating an
+// existing user must hold its lockUser lock, not us.mutex.
+func (us *UserService) saveUser(ctx context.Context, u, previous User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	claimed, err := us.claimIndexes(ctx, []User{u})
+	if err != nil {
+		return err
+	}
+
+	if err := us.redis.Set(ctx, userKey(u.ID), data, 0).Err(); err != nil {
+		us.releaseIndexes(ctx, claimed)
+		return err
+	}
+
+	var stale []indexClaim
+	if previous.Email != "" && emailIndexKey(previous.Email) != emailIndexKey(u.Email) {
+		stale = append(stale, indexClaim{key: emailIndexKey(previous.Email), id: u.ID})
+	}
+	if previous.Username != "" && us.usernameIndexKey(previous.Username) != us.usernameIndexKey(u.Username) {
+		stale = append(stale, indexClaim{key: us.usernameIndexKey(previous.Username), id: u.ID})
+	}
+	us.releaseIndexes(ctx, stale)
+	return nil
+}
+
+// insertUsers claims the index keys of a set of new users, then writes their
+// records to Redis in one pipeline. If any write fails, the records that
+// were written are deleted again and the claims released, so either all of
+// them are stored or none are.
+func (us *UserService) insertUsers(ctx context.Context, users []User) error {
+	records := make([][]byte, len(users))
+	for i, u := range users {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		records[i] = data
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	claimed, err := us.claimIndexes(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	_, err = us.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, u := range users {
+			pipe.Set(ctx, userKey(u.ID), records[i], 0)
+		}
+		return nil
+	})
+	if err != nil {
+		// The IDs are new, so deleting them can't drop anyone else's record
+		us.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, u := range users {
+				pipe.Del(ctx, userKey(u.ID))
+			}
+			return nil
+		})
+		us.releaseIndexes(ctx, claimed)
+	}
+	return err
+}
+
+// removeUser deletes a user's record from Redis and releases its index
+// entries. The caller must hold the user's lockUser lock.
+func (us *UserService) removeUser(ctx context.Context, u User) error {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	if err := us.redis.Del(ctx, userKey(u.ID)).Err(); err != nil {
+		return err
+	}
+	us.releaseIndexes(ctx, []indexClaim{
+		{key: emailIndexKey(u.Email), id: u.ID},
+		{key: us.usernameIndexKey(u.Username), id: u.ID},
+	})
+	return nil
+}
+
+// lookupIndex resolves an index key to a user ID, returning redis.Nil when
+// no user holds the value
+func (us *UserService) lookupIndex(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	return us.redis.Get(ctx, key).Result()
+}
+
+// rebuildIndexes replaces every index entry with ones derived from users,
+// clearing entries left behind by earlier versions or interrupted writes
+func (us *UserService) rebuildIndexes(ctx context.Context, users map[string]User) error {
+	var stale []string
+	for _, prefix := range []string{emailIndexPrefix, usernameIndexPrefix} {
+		keys, err := scanKeys(ctx, us.redis, prefix+"*", us.scanCount)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, keys...)
+	}
+
+	_, err := us.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range stale {
+			pipe.Del(ctx, key)
+		}
+		for _, user := range users {
+			us.setIndexes(ctx, pipe, user)
+		}
+		return nil
+	})
+	return err
+}
+
+// replaceUsers makes Redis hold exactly the given users, deleting the records
+// of current users that are not among them and re-pointing the indexes. A
+// restore is authoritative, so it overwrites index keys instead of claiming
+// them. In cluster mode the transaction is applied per slot. The caller must
+// hold us.mutex.
+func (us *UserService) replaceUsers(ctx context.Context, users map[string]User) error {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	_, err := us.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for id, current := range us.users {
+			if _, keep := users[id]; !keep {
+				pipe.Del(ctx, userKey(id))
+			}
+			pipe.Del(ctx, emailIndexKey(current.Email))
+			pipe.Del(ctx, us.usernameIndexKey(current.Username))
+		}
+		for _, user := range users {
+			data, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			pipe.Set(ctx, userKey(user.ID), data, 0)
+			us.setIndexes(ctx, pipe, user)
+		}
+		return nil
+	})
+	return err
+}
+
+// loadUsers reads every user record from Redis
+func (us *UserService) loadUsers(ctx context.Context) (map[string]User, error) {
+	keys, err := scanKeys(ctx, us.redis, userKeyPrefix+"*", us.scanCount)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]User, len(keys))
+	if len(keys) == 0 {
+		return users, nil
+	}
+
+	cmds, err := us.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		data, err := cmd.(*redis.StringCmd).Bytes()
+		if err == redis.Nil {
+			// Deleted between SCAN and GET
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			us.logger.WithError(err).WithField("key", cmd.Args()[1]).Warn("Skipping unreadable user record")
+			continue
+		}
+		users[user.ID] = user
+	}
+
+	return users, nil
+}
+
+// scanKeys returns all keys matching pattern using SCAN, never KEYS, so large
+// keyspaces do not block Redis. count is the COUNT hint for each call. In
+// cluster mode every master is scanned.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string, count int64) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern, count)
+	}
+
+	var mutex sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanNode(ctx, node, pattern, count)
+		mutex.Lock()
+		keys = append(keys, nodeKeys...)
+		mutex.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+// scanNode iterates a SCAN cursor on a single node to completion, stopping
+// early once ctx is done
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, count int64) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := client.Scan(ctx, cursor, pattern, count).Result()
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, batch...)
+
+		if next == 0 {
+			return keys, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return keys, err
+		}
+		cursor = next
+	}
+}
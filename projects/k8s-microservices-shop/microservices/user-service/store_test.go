@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestUnreachableRedisKeepsServiceNotReadyInsteadOfSeeding(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.Set(userKey("42"), `{"id":"42","username":"real","email":"real@example.com","role":"customer"}`)
+	t.Setenv("REDIS_URL", mr.Addr())
+	mr.Close()
+
+	registry := prometheus.NewRegistry()
+	us, err := NewUserService(registry, registry)
+	if err != nil {
+		t.Fatalf("NewUserService: %v", err)
+	}
+	us.logger.SetOutput(io.Discard)
+	t.Cleanup(func() { us.Close() })
+	handler := us.Handler()
+
+	if rec := doRequest(handler, "GET", "/ready", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /ready before load = %d, want 503", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/users", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /users before load = %d, want 503", rec.Code)
+	}
+	rec := doRequest(handler, "POST", "/users", `{"username":"real2","email":"real@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /users before load = %d, want 503", rec.Code)
+	}
+
+	// Once Redis is back the background retry loads the real users
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("restarting miniredis: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !us.loaded.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("users were not loaded after Redis came back")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	rec = doRequest(handler, "GET", "/users", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /users after load = %d, want 200", rec.Code)
+	}
+	var page userPage
+	decodeBody(t, rec, &page)
+	if page.Total != 1 || page.Users[0].Username != "real" {
+		t.Errorf("users after load = %+v, want only the stored user", page.Users)
+	}
+	if keys := mr.Keys(); strings.Contains(strings.Join(keys, " "), "admin") {
+		t.Errorf("sample users were written to Redis: %v", keys)
+	}
+}
+
+func TestIndexClaimedByAnotherReplicaIsAConflict(t *testing.T) {
+	us, mr := newTestService(t, nil)
+	handler := us.Handler()
+
+	// Another replica has just created these; this one hasn't seen them
+	mr.Set(emailIndexKey("taken@example.com"), "other-replica-user")
+	mr.Set(us.usernameIndexKey("taken"), "other-replica-user")
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"fresh","email":"taken@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("POST /users with a claimed email = %d, want 409", rec.Code)
+	}
+	var body map[string]string
+	decodeBody(t, rec, &body)
+	if body["field"] != "email" {
+		t.Errorf("conflict field = %q, want email", body["field"])
+	}
+	if mr.Exists(us.usernameIndexKey("fresh")) {
+		t.Error("username claim was not released after the email conflict")
+	}
+
+	rec = doRequest(handler, "POST", "/users/batch", `[{"username":"taken","email":"new@example.com","role":"customer"}]`, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("POST /users/batch with a claimed username = %d, want 409", rec.Code)
+	}
+	if mr.Exists(emailIndexKey("new@example.com")) {
+		t.Error("email claim was not released after the username conflict")
+	}
+
+	john := "/users/" + userIDByName(t, us, "john_doe")
+	etag := doRequest(handler, "GET", john, "", nil).Header().Get("ETag")
+	rec = doRequest(handler, "PATCH", john, `{"username":"taken"}`, map[string]string{"If-Match": etag})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("PATCH to a claimed username = %d, want 409", rec.Code)
+	}
+	if got, _ := mr.Get(us.usernameIndexKey("john_doe")); got != userIDByName(t, us, "john_doe") {
+		t.Errorf("john_doe's own index entry = %q after the failed rename", got)
+	}
+	if got, _ := mr.Get(us.usernameIndexKey("taken")); got != "other-replica-user" {
+		t.Errorf("claimed username now points at %q", got)
+	}
+
+	// Renaming to a free username still claims it
+	rec = doRequest(handler, "PATCH", john, `{"username":"johnny"}`, map[string]string{"If-Match": etag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH to a free username = %d, want 200", rec.Code)
+	}
+	if mr.Exists(us.usernameIndexKey("john_doe")) || !mr.Exists(us.usernameIndexKey("johnny")) {
+		t.Errorf("index keys after rename: %v", mr.Keys())
+	}
+}
+
+func TestChangedEmailAndUsernameFreeTheOldIndexKeys(t *testing.T) {
+	us, mr := newTestService(t, nil)
+	handler := us.Handler()
+	id := userIDByName(t, us, "john_doe")
+
+	rec := doRequest(handler, "PUT", "/users/"+id, `{"username":"johnny","email":"johnny@example.com","name":"John Doe","role":"customer"}`, map[string]string{"If-Match": "*"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", rec.Code, rec.Body.String())
+	}
+	if mr.Exists(emailIndexKey("john@example.com")) || mr.Exists(us.usernameIndexKey("john_doe")) {
+		t.Errorf("old index keys survived the PUT: %v", mr.Keys())
+	}
+	for _, key := range []string{emailIndexKey("johnny@example.com"), us.usernameIndexKey("johnny")} {
+		if got, _ := mr.Get(key); got != id {
+			t.Errorf("%s = %q, want %q", key, got, id)
+		}
+	}
+
+	rec = doRequest(handler, "PATCH", "/users/"+id, `{"email":"jd@example.com"}`, map[string]string{"If-Match": "*"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d: %s", rec.Code, rec.Body.String())
+	}
+	if mr.Exists(emailIndexKey("johnny@example.com")) {
+		t.Errorf("old email key survived the PATCH: %v", mr.Keys())
+	}
+	if got, _ := mr.Get(emailIndexKey("jd@example.com")); got != id {
+		t.Errorf("new email key = %q, want %q", got, id)
+	}
+
+	// The freed values can be claimed by someone else
+	rec = doRequest(handler, "POST", "/users", `{"username":"john_doe","email":"john@example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("reusing the freed username and email = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUserKeysArePerUserHashTags(t *testing.T) {
+	us, mr := newTestService(t, nil)
+	handler := us.Handler()
+
+	rec := doRequest(handler, "POST", "/users", `{"username":"tagged","email":"Tagged@Example.com","role":"customer"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /users = %d, want 201", rec.Code)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+
+	// Each key hashes on its own tag, so users spread over cluster slots
+	for _, key := range []string{"user:{" + user.ID + "}", "idx:email:{tagged@example.com}", "idx:username:{tagged}"} {
+		if !mr.Exists(key) {
+			t.Errorf("key %s missing; keys are %v", key, mr.Keys())
+		}
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "{users}") {
+			t.Errorf("key %s still shares the global hash tag", key)
+		}
+	}
+
+	if rec := doRequest(handler, "DELETE", "/users/"+user.ID, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", rec.Code)
+	}
+	for _, key := range []string{userKey(user.ID), emailIndexKey(user.Email), us.usernameIndexKey(user.Username)} {
+		if mr.Exists(key) {
+			t.Errorf("key %s left behind after delete", key)
+		}
+	}
+}
+
+func TestRedisClusterClientConstruction(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		addrs []string
+	}{
+		{"REDIS_CLUSTER_ADDRS", map[string]string{"REDIS_CLUSTER_ADDRS": "node-a:7000, node-b:7001"}, []string{"node-a:7000", "node-b:7001"}},
+		{"REDIS_CLUSTER with a REDIS_URL list", map[string]string{"REDIS_CLUSTER": "true", "REDIS_URL": "node-a:7000,node-b:7001"}, []string{"node-a:7000", "node-b:7001"}},
+		{"single node", map[string]string{"REDIS_URL": "node-a:6379"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			client := newRedisClient(0)
+			defer client.Close()
+
+			cluster, ok := client.(*redis.ClusterClient)
+			if tt.addrs == nil {
+				if ok {
+					t.Fatal("built a *redis.ClusterClient for a single node")
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("built a %T, want *redis.ClusterClient", client)
+			}
+			if got := strings.Join(cluster.Options().Addrs, ","); got != strings.Join(tt.addrs, ",") {
+				t.Errorf("cluster addresses = %s, want %s", got, strings.Join(tt.addrs, ","))
+			}
+		})
+	}
+}
+
+func TestScanKeysWalksEveryClusterMaster(t *testing.T) {
+	// miniredis answers CLUSTER SLOTS as a one-master cluster
+	mr := miniredis.RunT(t)
+	for _, id := range []string{"1", "2", "3"} {
+		mr.Set(userKey(id), `{"id":"`+id+`","username":"user`+id+`","email":"user`+id+`@example.com","role":"customer"}`)
+	}
+	mr.Set("other:key", "unrelated")
+
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	defer cluster.Close()
+
+	keys, err := scanKeys(context.Background(), cluster, userKeyPrefix+"*", 100)
+	if err != nil {
+		t.Fatalf("scanKeys: %v", err)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "user:{1},user:{2},user:{3}" {
+		t.Errorf("scanned keys = %s", got)
+	}
+
+	// The service hydrates and writes through the cluster client too
+	us, _ := newTestService(t, map[string]string{"REDIS_CLUSTER_ADDRS": mr.Addr()})
+	if _, ok := us.redis.(*redis.ClusterClient); !ok {
+		t.Fatalf("service built a %T, want *redis.ClusterClient", us.redis)
+	}
+	if len(us.users) != 3 {
+		t.Errorf("hydrated %d users through the cluster client, want 3", len(us.users))
+	}
+}
+
+// pagedScanHook answers SCAN from keys, count keys per call, the way a real
+// Redis pages a large keyspace; miniredis ignores COUNT. cancel, when set, is
+// called after the first page.
+type pagedScanHook struct {
+	keys   []string
+	calls  int
+	counts []int64
+	cancel context.CancelFunc
+}
+
+func (h *pagedScanHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *pagedScanHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (h *pagedScanHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		scan, ok := cmd.(*redis.ScanCmd)
+		if !ok {
+			return next(ctx, cmd)
+		}
+		args := cmd.Args()
+		cursor := args[1].(uint64)
+		count := args[len(args)-1].(int64)
+		h.calls++
+		h.counts = append(h.counts, count)
+
+		end := cursor + uint64(count)
+		next := end
+		if end >= uint64(len(h.keys)) {
+			end, next = uint64(len(h.keys)), 0
+		}
+		scan.SetVal(h.keys[cursor:end], next)
+		if h.cancel != nil {
+			h.cancel()
+		}
+		return nil
+	}
+}
+
+func TestScanNodeFollowsTheCursorPastCount(t *testing.T) {
+	hook := &pagedScanHook{}
+	for i := 0; i < 250; i++ {
+		hook.keys = append(hook.keys, userKey(strconv.Itoa(i)))
+	}
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	client.AddHook(hook)
+
+	keys, err := scanNode(context.Background(), client, userKeyPrefix+"*", 100)
+	if err != nil {
+		t.Fatalf("scanNode: %v", err)
+	}
+	if len(keys) != 250 {
+		t.Errorf("scanned %d keys, want 250", len(keys))
+	}
+	if hook.calls != 3 {
+		t.Errorf("made %d SCAN calls, want 3", hook.calls)
+	}
+	for _, count := range hook.counts {
+		if count != 100 {
+			t.Errorf("SCAN sent COUNT %d, want 100", count)
+		}
+	}
+
+	// A cancelled context stops the iteration between cursors
+	ctx, cancel := context.WithCancel(context.Background())
+	hook.calls, hook.cancel = 0, cancel
+	keys, err = scanNode(ctx, client, userKeyPrefix+"*", 100)
+	if err != context.Canceled {
+		t.Errorf("scanNode after cancel returned %v, want context.Canceled", err)
+	}
+	if hook.calls != 1 || len(keys) != 100 {
+		t.Errorf("scanNode after cancel made %d calls and returned %d keys, want 1 and 100", hook.calls, len(keys))
+	}
+}
+
+func TestScanCountFromEnv(t *testing.T) {
+	for value, want := range map[string]int64{"": 100, "500": 500, "0": 100, "many": 100} {
+		us, _ := newTestService(t, map[string]string{"REDIS_SCAN_COUNT": value})
+		if us.scanCount != want {
+			t.Errorf("REDIS_SCAN_COUNT=%q gave a count of %d, want %d", value, us.scanCount, want)
+		}
+	}
+}
+
+func TestCloseStopsTheLoadRetry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+	mr.Close()
+
+	registry := prometheus.NewRegistry()
+	us, err := NewUserService(registry, registry)
+	if err != nil {
+		t.Fatalf("NewUserService: %v", err)
+	}
+	us.logger.SetOutput(io.Discard)
+
+	// Close waits for the retry, so it only returns once the retry stopped
+	closed := make(chan struct{})
+	go func() {
+		us.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return; the load retry is still running")
+	}
+
+}